@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdigger/rest"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Admin описывает учетную запись администратора.
+type Admin struct {
+	Name        string   `json:"-"`                     // имя администратора
+	Password    Password `json:"password"`              // хеш пароля
+	TOTP        string   `json:"totp,omitempty"`        // ключ одноразовых кодов
+	PendingTOTP string   `json:"pendingTotp,omitempty"` // ключ до подтверждения
+	Roles       []string `json:"roles"`                 // роли администратора
+	Groups      []string `json:"groups,omitempty"`      // доступные группы
+	Tenants     []string `json:"tenants,omitempty"`     // доступные Azure AD
+}
+
+// decodeAdmin разбирает сохраненное описание администратора. Для
+// совместимости поддерживается старый формат, в котором сохранялся только
+// хеш пароля.
+func decodeAdmin(name string, data []byte) (*Admin, error) {
+	var admin = &Admin{Name: name}
+	if len(data) > 1 && data[0] == '{' {
+		if err := json.Unmarshal(data, admin); err != nil {
+			return nil, err
+		}
+	} else {
+		admin.Password = Password(data)
+	}
+	return admin, nil
+}
+
+// Admin возвращает информацию об администраторе с указанным именем.
+func (s *Store) Admin(name string) (*Admin, error) {
+	var admin *Admin
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		var bucket = tx.Bucket([]byte(sectionAdmins))
+		if bucket == nil {
+			return rest.ErrNotFound
+		}
+		var data = bucket.Get([]byte(name))
+		if data == nil {
+			return rest.ErrNotFound
+		}
+		var err error
+		admin, err = decodeAdmin(name, data)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return admin, nil
+}
+
+// removeAdmin удаляет администратора вместе с его ключами API и завершает
+// все его сессии. Если администратор не найден, то возвращается
+// rest.ErrNotFound.
+func (s *Store) removeAdmin(name string) error {
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		var bucket = tx.Bucket([]byte(sectionAdmins))
+		if bucket == nil || bucket.Get([]byte(name)) == nil {
+			return rest.ErrNotFound
+		}
+		if err := bucket.Delete([]byte(name)); err != nil {
+			return err
+		}
+		return removeAPIKeys(tx, name)
+	}); err != nil {
+		return err
+	}
+	removeAdminSessions(name)
+	return nil
+}
+
+// RemoveAdmin удаляет администратора вместе с его ключами API и сессиями.
+func (s *Store) RemoveAdmin(c *rest.Context) error {
+	var name = c.Param("name")
+	if err := s.removeAdmin(name); err == rest.ErrNotFound {
+		return c.Error(http.StatusNotFound, "item not found")
+	} else if err != nil {
+		return err
+	}
+	auditLog.Info("admin removed", "admin", name)
+	return nil
+}
+
+// AdminItem отдает информацию об администраторе. Ключи для генерации
+// одноразовых кодов не отдаются.
+func (s *Store) AdminItem(c *rest.Context) error {
+	admin, err := s.Admin(c.Param("name"))
+	if err == rest.ErrNotFound {
+		return c.Error(http.StatusNotFound, "item not found")
+	}
+	if err != nil {
+		return err
+	}
+	return c.Write(rest.JSON{
+		"password": admin.Password,
+		"totp":     admin.TOTP != "",
+		"roles":    admin.Roles,
+		"groups":   admin.Groups,
+		"tenants":  admin.Tenants,
+	})
+}
+
+// AdminSessionPeriod определяет время действия сессии администратора.
+var AdminSessionPeriod = time.Minute * 15
+
+// adminSession описывает авторизованную сессию администратора.
+type adminSession struct {
+	Name     string    // имя администратора
+	Expires  time.Time // время окончания действия
+	External *Admin    // администратор, авторизованный внешним провайдером
+}
+
+// adminSessions хранит список авторизованных сессий администраторов.
+var adminSessions = struct {
+	list map[string]adminSession
+	mu   sync.Mutex
+}{list: make(map[string]adminSession)}
+
+// newAdminSession создает новую сессию администратора и возвращает ее токен.
+// Для администраторов, авторизованных внешним провайдером и отсутствующих в
+// хранилище, передается их описание.
+func newAdminSession(name string, external *Admin) (string, time.Time, error) {
+	var data = make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return "", time.Time{}, err
+	}
+	var token = base64.RawURLEncoding.EncodeToString(data)
+	var now = time.Now()
+	var expires = now.Add(AdminSessionPeriod)
+	adminSessions.mu.Lock()
+	// заодно удаляем устаревшие сессии
+	for token, session := range adminSessions.list {
+		if now.After(session.Expires) {
+			delete(adminSessions.list, token)
+		}
+	}
+	adminSessions.list[token] = adminSession{
+		Name:     name,
+		Expires:  expires,
+		External: external,
+	}
+	adminSessions.mu.Unlock()
+	return token, expires, nil
+}
+
+// checkAdminSession возвращает описание сессии администратора для токена.
+// Если сессия не найдена или истекла, то возвращается false.
+func checkAdminSession(token string) (adminSession, bool) {
+	adminSessions.mu.Lock()
+	defer adminSessions.mu.Unlock()
+	var session, ok = adminSessions.list[token]
+	if !ok {
+		return session, false
+	}
+	if time.Now().After(session.Expires) {
+		delete(adminSessions.list, token)
+		return session, false
+	}
+	return session, true
+}
+
+// removeAdminSessions удаляет все сессии администратора.
+func removeAdminSessions(name string) {
+	adminSessions.mu.Lock()
+	for token, session := range adminSessions.list {
+		if session.Name == name {
+			delete(adminSessions.list, token)
+		}
+	}
+	adminSessions.mu.Unlock()
+}
+
+type adminKey struct{} // ключ контекста с описанием администратора
+
+// adminPrefix добавляется к имени администратора при учете неудачных
+// попыток авторизации.
+const adminPrefix = "admin:"
+
+// currentAdmin возвращает описание авторизованного администратора. Для
+// сервиса без администраторов возвращается nil.
+func currentAdmin(c *rest.Context) *Admin {
+	admin, _ := c.Request.Context().Value(adminKey{}).(*Admin)
+	return admin
+}
+
+// oidcConfigured возвращает true, если настроена авторизация администраторов
+// через OpenID Connect.
+func oidcConfigured(tx *bolt.Tx) bool {
+	var bucket = tx.Bucket([]byte(sectionConfig))
+	return bucket != nil && bucket.Get([]byte("oidc")) != nil
+}
+
+// AdminAuth проверяет авторизацию администратора сервиса, если она задана.
+// Авторизация требуется, если задан хотя бы один администратор или настроена
+// авторизация через OpenID Connect.
+// Поддерживается авторизация HTTP Basic, токены сессий, выданные Login, и
+// ключи API. Для администраторов с включенными одноразовыми кодами при
+// авторизации HTTP Basic код передается в заголовке X-OTP.
+func (s *Store) AdminAuth(c *rest.Context) error {
+	var admin *Admin
+	var rehash string  // пароль для пересчета хеша
+	var apiKey *APIKey // использованный ключ API
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		var bucket = tx.Bucket([]byte(sectionAdmins))
+		// если администраторы не заданы и не настроена авторизация через
+		// OpenID Connect, то авторизация не требуется
+		if (bucket == nil || bucket.Stats().KeyN == 0) && !oidcConfigured(tx) {
+			return nil
+		}
+		// adminData возвращает сохраненное описание администратора
+		var adminData = func(name string) []byte {
+			if bucket == nil {
+				return nil
+			}
+			return bucket.Get([]byte(name))
+		}
+		var auth = c.Header("Authorization")
+		if strings.HasPrefix(auth, "Bearer ") {
+			var token = strings.TrimPrefix(auth, "Bearer ")
+			var name string
+			if strings.HasPrefix(token, apiKeyPrefix) {
+				var err error
+				apiKey, err = checkAPIKey(tx, token, clientIP(c.Request))
+				if err != nil {
+					return err
+				}
+				name = apiKey.Admin
+				c.AddLogField("key", apiKey.Name)
+			} else {
+				session, ok := checkAdminSession(token)
+				if !ok {
+					return c.Error(http.StatusForbidden, "bad admin session")
+				}
+				name = session.Name
+				if session.External != nil {
+					c.AddLogField("admin", name)
+					admin = session.External
+					return nil
+				}
+			}
+			c.AddLogField("admin", name)
+			var data = adminData(name)
+			if data == nil {
+				return c.Error(http.StatusForbidden, "bad admin name")
+			}
+			var err error
+			admin, err = decodeAdmin(name, data)
+			return err
+		}
+		username, password, ok := c.BasicAuth()
+		if !ok {
+			var realm = fmt.Sprintf("Basic realm=%s admin", appName)
+			c.SetHeader("WWW-Authenticate", realm)
+			return rest.ErrUnauthorized
+		}
+		c.AddLogField("admin", username) // добавляем в лог имя администратора
+		// неудачные попытки учитываются вместе с попытками пользователей;
+		// имя администратора отличается от email префиксом
+		var ip, key = clientIP(c.Request), adminPrefix + username
+		if wait := authAttempts.Wait(key, ip); wait > 0 {
+			return tooManyRequests(c, wait)
+		}
+		var data = adminData(username)
+		if data == nil {
+			authAttempts.Fail(key, ip)
+			return c.Error(http.StatusForbidden, "bad admin name")
+		}
+		var err error
+		admin, err = decodeAdmin(username, data)
+		if err != nil {
+			return err
+		}
+		if !admin.Password.Compare(password) {
+			authAttempts.Fail(key, ip)
+			return c.Error(http.StatusForbidden, "bad admin password")
+		}
+		if admin.TOTP != "" {
+			var code = c.Header("X-OTP")
+			if code == "" {
+				return c.Error(http.StatusUnauthorized, "admin otp code required")
+			}
+			if !VerifyTOTP(admin.TOTP, code) {
+				authAttempts.Fail(key, ip)
+				return c.Error(http.StatusForbidden, "bad admin otp code")
+			}
+		}
+		authAttempts.Reset(key)
+		// пересчитываем хеш пароля с текущими параметрами
+		if admin.Password.NeedsRehash() {
+			rehash = password
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if admin == nil {
+		return nil // авторизация не требуется
+	}
+	if err := s.checkAccess(c, admin); err != nil {
+		return err
+	}
+	c.Request = c.Request.WithContext(
+		context.WithValue(c.Request.Context(), adminKey{}, admin))
+	if apiKey != nil {
+		return s.touchAPIKey(apiKey)
+	}
+	if rehash != "" {
+		return s.rehashPassword(sectionAdmins, admin.Name, admin.Password, rehash)
+	}
+	return nil
+}
+
+// Login выдает токен сессии авторизованному администратору. Запросы с этим
+// токеном в заголовке HTTP Bearer не требуют повторного ввода пароля и
+// одноразового кода до окончания действия сессии.
+func (s *Store) Login(c *rest.Context) error {
+	var admin = currentAdmin(c)
+	if admin == nil {
+		return c.Error(http.StatusBadRequest, "admins not configured")
+	}
+	if _, _, ok := c.BasicAuth(); !ok {
+		return c.Error(http.StatusBadRequest, "basic authorization required")
+	}
+	token, expires, err := newAdminSession(admin.Name, nil)
+	if err != nil {
+		return err
+	}
+	return c.Write(rest.JSON{
+		"token":   token,
+		"type":    "Bearer",
+		"expires": expires.UTC(),
+	})
+}
+
+// Logout завершает сессию администратора.
+func (s *Store) Logout(c *rest.Context) error {
+	var auth = c.Header("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return c.Error(http.StatusBadRequest, "bearer authorization required")
+	}
+	adminSessions.mu.Lock()
+	delete(adminSessions.list, strings.TrimPrefix(auth, "Bearer "))
+	adminSessions.mu.Unlock()
+	return nil
+}
+
+// EnrollTOTP создает новый ключ для генерации одноразовых кодов
+// администратора и отдает его вместе с otpauth URI. Ключ начинает
+// использоваться только после подтверждения с помощью ConfirmTOTP.
+func (s *Store) EnrollTOTP(c *rest.Context) error {
+	admin, err := s.Admin(c.Param("name"))
+	if err == rest.ErrNotFound {
+		return c.Error(http.StatusNotFound, "admin not found")
+	}
+	if err != nil {
+		return err
+	}
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		return err
+	}
+	admin.PendingTOTP = secret
+	if err := s.save(sectionAdmins, admin.Name, admin); err != nil {
+		return err
+	}
+	return c.Write(rest.JSON{
+		"secret": secret,
+		"uri":    TOTPURI(admin.Name, secret),
+	})
+}
+
+// ConfirmTOTP проверяет одноразовый код, сгенерированный с помощью нового
+// ключа, и включает для администратора обязательный ввод одноразовых кодов.
+func (s *Store) ConfirmTOTP(c *rest.Context) error {
+	var data = new(struct {
+		Code string `json:"code"`
+	})
+	if err := c.Bind(data); err != nil {
+		return c.Error(http.StatusBadRequest, err.Error())
+	}
+	admin, err := s.Admin(c.Param("name"))
+	if err == rest.ErrNotFound {
+		return c.Error(http.StatusNotFound, "admin not found")
+	}
+	if err != nil {
+		return err
+	}
+	if admin.PendingTOTP == "" {
+		return c.Error(http.StatusBadRequest, "otp enrollment not started")
+	}
+	if !VerifyTOTP(admin.PendingTOTP, data.Code) {
+		return c.Error(http.StatusBadRequest, "bad otp code")
+	}
+	admin.TOTP, admin.PendingTOTP = admin.PendingTOTP, ""
+	if err := s.save(sectionAdmins, admin.Name, admin); err != nil {
+		return err
+	}
+	removeAdminSessions(admin.Name)
+	return nil
+}
+
+// RemoveTOTP отключает для администратора одноразовые коды.
+func (s *Store) RemoveTOTP(c *rest.Context) error {
+	admin, err := s.Admin(c.Param("name"))
+	if err == rest.ErrNotFound {
+		return c.Error(http.StatusNotFound, "admin not found")
+	}
+	if err != nil {
+		return err
+	}
+	admin.TOTP, admin.PendingTOTP = "", ""
+	return s.save(sectionAdmins, admin.Name, admin)
+}
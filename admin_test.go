@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mdigger/rest"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestRemoveAdmin(t *testing.T) {
+	var store = testStore(t)
+	for _, name := range []string{"admin", "other"} {
+		if err := store.save(sectionAdmins, name, &Admin{Password: "password"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id, admin := range map[string]string{"k1": "admin", "k2": "admin", "k3": "other"} {
+		if err := store.save(sectionKeys, id, &APIKey{Admin: admin, Name: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	token, _, err := newAdminSession("admin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := newAdminSession("other", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.removeAdmin("admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.removeAdmin("admin"); err != rest.ErrNotFound {
+		t.Fatalf("second remove: %v", err)
+	}
+	if _, err := store.Admin("admin"); err != rest.ErrNotFound {
+		t.Fatalf("admin not removed: %v", err)
+	}
+	if err := store.db.View(func(tx *bolt.Tx) error {
+		var bucket = tx.Bucket([]byte(sectionKeys))
+		for id, exists := range map[string]bool{"k1": false, "k2": false, "k3": true} {
+			if (bucket.Get([]byte(id)) != nil) != exists {
+				t.Errorf("key %s exists: %v", id, !exists)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := checkAdminSession(token); ok {
+		t.Error("admin session not removed")
+	}
+	if _, ok := checkAdminSession(other); !ok {
+		t.Error("other admin session removed")
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mdigger/rest"
+	bolt "go.etcd.io/bbolt"
+)
+
+// apiKeyPrefix задает префикс ключей API, по которому они отличаются от
+// токенов сессий администраторов.
+const apiKeyPrefix = "key."
+
+// APIKey описывает именованный ключ API администратора, предназначенный для
+// автоматизированного доступа. Сам ключ не сохраняется — хранится только его
+// хеш.
+type APIKey struct {
+	ID       string     `json:"-"`                  // идентификатор ключа
+	Admin    string     `json:"admin"`              // имя администратора
+	Name     string     `json:"name"`               // название ключа
+	Hash     string     `json:"hash,omitempty"`     // хеш секретной части
+	Created  time.Time  `json:"created"`            // время создания
+	Expires  *time.Time `json:"expires,omitempty"`  // время окончания действия
+	IPs      []string   `json:"ips,omitempty"`      // разрешенные адреса и сети
+	LastUsed *time.Time `json:"lastUsed,omitempty"` // время использования
+}
+
+// hashAPIKey возвращает хеш секретной части ключа API. Ключ генерируется
+// случайным образом и имеет достаточную длину, поэтому медленные алгоритмы
+// хеширования для него не используются.
+func hashAPIKey(secret string) string {
+	var sum = sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// AllowedIP возвращает true, если ключ может использоваться с указанного
+// адреса. Если список адресов не задан, то ограничений нет.
+func (k *APIKey) AllowedIP(addr string) bool {
+	if len(k.IPs) == 0 {
+		return true
+	}
+	var ip = net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, allowed := range k.IPs {
+		if _, network, err := net.ParseCIDR(allowed); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if allowed := net.ParseIP(allowed); allowed != nil && allowed.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAPIKey проверяет ключ API в рамках транзакции и возвращает его
+// описание.
+func checkAPIKey(tx *bolt.Tx, token, ip string) (*APIKey, error) {
+	var parts = strings.SplitN(strings.TrimPrefix(token, apiKeyPrefix), ".", 2)
+	if len(parts) != 2 {
+		return nil, rest.NewError(http.StatusForbidden, "bad admin api key")
+	}
+	var bucket = tx.Bucket([]byte(sectionKeys))
+	if bucket == nil {
+		return nil, rest.NewError(http.StatusForbidden, "bad admin api key")
+	}
+	var data = bucket.Get([]byte(parts[0]))
+	if data == nil {
+		return nil, rest.NewError(http.StatusForbidden, "bad admin api key")
+	}
+	var key = &APIKey{ID: parts[0]}
+	if err := json.Unmarshal(data, key); err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(key.Hash),
+		[]byte(hashAPIKey(parts[1]))) != 1 {
+		return nil, rest.NewError(http.StatusForbidden, "bad admin api key")
+	}
+	if key.Expires != nil && time.Now().After(*key.Expires) {
+		return nil, rest.NewError(http.StatusForbidden, "admin api key expired")
+	}
+	if !key.AllowedIP(ip) {
+		return nil, rest.NewError(http.StatusForbidden, "admin api key address not allowed")
+	}
+	return key, nil
+}
+
+// removeAPIKeys удаляет все ключи API администратора в рамках транзакции.
+func removeAPIKeys(tx *bolt.Tx, name string) error {
+	var bucket = tx.Bucket([]byte(sectionKeys))
+	if bucket == nil {
+		return nil
+	}
+	var ids [][]byte
+	if err := bucket.ForEach(func(k, v []byte) error {
+		var key = new(APIKey)
+		if err := json.Unmarshal(v, key); err != nil {
+			return err
+		}
+		if key.Admin == name {
+			ids = append(ids, k)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := bucket.Delete(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// touchAPIKey сохраняет время последнего использования ключа API. Чтобы не
+// записывать данные при каждом запросе, время обновляется не чаще раза в
+// минуту.
+func (s *Store) touchAPIKey(key *APIKey) error {
+	var now = time.Now().UTC()
+	if key.LastUsed != nil && now.Sub(*key.LastUsed) < time.Minute {
+		return nil
+	}
+	key.LastUsed = &now
+	data, err := json.MarshalIndent(key, "", "    ")
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		var bucket = tx.Bucket([]byte(sectionKeys))
+		// ключ мог быть отозван во время выполнения запроса
+		if bucket == nil || bucket.Get([]byte(key.ID)) == nil {
+			return nil
+		}
+		return bucket.Put([]byte(key.ID), data)
+	})
+}
+
+// CreateAPIKey создает новый ключ API для администратора и отдает его.
+// Ключ отдается только один раз и в дальнейшем не может быть получен.
+func (s *Store) CreateAPIKey(c *rest.Context) error {
+	var params = new(struct {
+		Name    string     `json:"name"`
+		Expires *time.Time `json:"expires"`
+		IPs     []string   `json:"ips"`
+	})
+	if err := c.Bind(params); err != nil {
+		return c.Error(http.StatusBadRequest, err.Error())
+	}
+	if params.Name == "" {
+		return c.Error(http.StatusBadRequest, "key name required")
+	}
+	for _, addr := range params.IPs {
+		if _, _, err := net.ParseCIDR(addr); err != nil && net.ParseIP(addr) == nil {
+			return c.Error(http.StatusBadRequest, "bad ip address "+addr)
+		}
+	}
+	var name = c.Param("name")
+	if _, err := s.Admin(name); err == rest.ErrNotFound {
+		return c.Error(http.StatusNotFound, "admin not found")
+	} else if err != nil {
+		return err
+	}
+	var data = make([]byte, 40)
+	if _, err := rand.Read(data); err != nil {
+		return err
+	}
+	var id = hex.EncodeToString(data[:8])
+	var secret = base64.RawURLEncoding.EncodeToString(data[8:])
+	var key = &APIKey{
+		ID:      id,
+		Admin:   name,
+		Name:    params.Name,
+		Hash:    hashAPIKey(secret),
+		Created: time.Now().UTC(),
+		Expires: params.Expires,
+		IPs:     params.IPs,
+	}
+	if err := s.save(sectionKeys, id, key); err != nil {
+		return err
+	}
+	key.Hash = ""
+	return c.Write(rest.JSON{
+		"id":   id,
+		"key":  apiKeyPrefix + id + "." + secret,
+		"info": key,
+	})
+}
+
+// APIKeys отдает список ключей API администратора без их секретной части.
+func (s *Store) APIKeys(c *rest.Context) error {
+	var name = c.Param("name")
+	var list = make(map[string]*APIKey)
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		var bucket = tx.Bucket([]byte(sectionKeys))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var key = new(APIKey)
+			if err := json.Unmarshal(v, key); err != nil {
+				return err
+			}
+			if key.Admin == name {
+				key.Hash = ""
+				list[string(k)] = key
+			}
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+	return c.Write(rest.JSON{sectionKeys: list})
+}
+
+// RemoveAPIKey отзывает ключ API администратора.
+func (s *Store) RemoveAPIKey(c *rest.Context) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		var bucket = tx.Bucket([]byte(sectionKeys))
+		if bucket == nil {
+			return c.Error(http.StatusNotFound, "key not found")
+		}
+		var id = c.Param("id")
+		var data = bucket.Get([]byte(id))
+		if data == nil {
+			return c.Error(http.StatusNotFound, "key not found")
+		}
+		var key = new(APIKey)
+		if err := json.Unmarshal(data, key); err != nil {
+			return err
+		}
+		if key.Admin != c.Param("name") {
+			return c.Error(http.StatusNotFound, "key not found")
+		}
+		return bucket.Delete([]byte(id))
+	})
+}
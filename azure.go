@@ -2,72 +2,269 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	app "github.com/mdigger/app-info"
 	"github.com/mdigger/jwt"
+	"github.com/mdigger/log"
 	"github.com/mdigger/rest"
+	bolt "go.etcd.io/bbolt"
 )
 
 var (
 	jwksURL    = "https://login.microsoftonline.com/common/discovery/keys"
 	httpClient = &http.Client{Timeout: time.Second * 10}
-	authKeys   = new(Auth)
+	authKeys   = NewAuth(jwksURL)
 )
 
-// Auth отвечате за авторизацию и проверку токенов.
+// Параметры кеширования списков ключей.
+var (
+	JWKSDefaultTTL  = time.Hour       // если время не задано в Cache-Control
+	JWKSMinTTL      = time.Minute * 5 // минимальное время кеширования
+	JWKSMaxTTL      = time.Hour * 24  // максимальное время кеширования
+	JWKSMinInterval = time.Minute     // минимальный интервал между запросами
+	JWKSNegativeTTL = time.Minute * 5 // время хранения неизвестных ключей
+	jwksNegativeMax = 1000            // максимальное количество неизвестных ключей
+	jwksStore       *Store            // хранилище последних полученных ключей
+	jwksCaches      = make(map[string]*Auth)
+	jwksCachesMu    sync.Mutex
+)
+
+// Auth отвечате за авторизацию и проверку токенов. Полученный список ключей
+// кешируется с учетом заголовка Cache-Control и обновляется в фоне, а запросы
+// с неизвестными идентификаторами ключей не чаще JWKSMinInterval приводят к
+// повторному запросу списка.
 type Auth struct {
-	jwkeys map[string]interface{} // список ключей
-	mu     sync.RWMutex
+	stats    JWKSStats              // статистика использования
+	url      string                 // адрес для получения списка ключей
+	jwkeys   map[string]interface{} // список ключей
+	expires  time.Time              // время окончания кеширования
+	fetched  time.Time              // время последнего запроса
+	negative map[string]time.Time   // неизвестные идентификаторы ключей
+	mu       sync.RWMutex
+	fetch    sync.Mutex // только один запрос списка ключей одновременно
+}
+
+// JWKSStats содержит статистику использования списка ключей.
+type JWKSStats struct {
+	Hits         uint64     `json:"hits"`         // найденные ключи
+	Misses       uint64     `json:"misses"`       // неизвестные ключи
+	NegativeHits uint64     `json:"negativeHits"` // повторные неизвестные ключи
+	Fetches      uint64     `json:"fetches"`      // запросы списка ключей
+	Errors       uint64     `json:"errors"`       // ошибки запросов
+	Keys         int        `json:"keys"`         // количество ключей
+	Fetched      *time.Time `json:"fetched,omitempty"`
+	Expires      *time.Time `json:"expires,omitempty"`
+	LastError    string     `json:"lastError,omitempty"`
+}
+
+// NewAuth возвращает Auth для проверки токенов с помощью ключей, получаемых по
+// указанному адресу. Для одного адреса всегда возвращается один и тот же
+// кеш ключей.
+func NewAuth(url string) *Auth {
+	jwksCachesMu.Lock()
+	defer jwksCachesMu.Unlock()
+	if auth, ok := jwksCaches[url]; ok {
+		return auth
+	}
+	var auth = &Auth{url: url, negative: make(map[string]time.Time)}
+	jwksCaches[url] = auth
+	return auth
 }
 
+// errUnknownKey возвращается для ключей, отсутствующих в списке.
+var errUnknownKey = errors.New("unknown token key id")
+
 // GetKey возвращает ключ для проверки подписи по его идентификатору. Если
-// необходимо, то происходит загрузка ключей.
+// ключ неизвестен, то список ключей запрашивается повторно, но не чаще
+// JWKSMinInterval.
 func (a *Auth) GetKey(_, keyID string) interface{} {
-	authKeys.mu.Lock()
-	defer authKeys.mu.Unlock()
-	// возвращаем ключ, если он существует
-	if authKeys.jwkeys != nil {
-		if key, ok := authKeys.jwkeys[keyID]; ok {
+	var now = time.Now()
+	a.mu.RLock()
+	key, ok := a.jwkeys[keyID]
+	until, negative := a.negative[keyID]
+	var recent = now.Sub(a.fetched) < JWKSMinInterval
+	a.mu.RUnlock()
+	switch {
+	case ok:
+		atomic.AddUint64(&a.stats.Hits, 1)
+		return key
+	case negative && now.Before(until):
+		atomic.AddUint64(&a.stats.NegativeHits, 1)
+		return errUnknownKey
+	}
+	atomic.AddUint64(&a.stats.Misses, 1)
+	if !recent {
+		// ключ не найден — получаем актуальный список ключей
+		if err := a.refresh(); err != nil && a.keys() == 0 {
+			return err
+		}
+		a.mu.RLock()
+		key, ok = a.jwkeys[keyID]
+		a.mu.RUnlock()
+		if ok {
 			return key
 		}
 	}
-	// ключ не найден — получаем актуальный список ключей
-	keys, err := GetJWKeys(jwksURL)
+	a.mu.Lock()
+	if len(a.negative) >= jwksNegativeMax {
+		a.negative = make(map[string]time.Time)
+	}
+	until = now.Add(JWKSNegativeTTL)
+	if recent {
+		// список ключей не запрашивался: ключ проверяется снова, как только
+		// запрос станет возможен
+		if next := a.fetched.Add(JWKSMinInterval); next.Before(until) {
+			until = next
+		}
+	}
+	a.negative[keyID] = until
+	a.mu.Unlock()
+	return errUnknownKey
+}
+
+// keys возвращает количество ключей в кеше.
+func (a *Auth) keys() int {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return len(a.jwkeys)
+}
+
+// refresh запрашивает список ключей. Если список уже был запрошен менее
+// JWKSMinInterval назад, то повторный запрос не выполняется. В случае ошибки
+// продолжает использоваться последний полученный список.
+func (a *Auth) refresh() error {
+	a.fetch.Lock()
+	defer a.fetch.Unlock()
+	var now = time.Now()
+	a.mu.Lock()
+	if now.Sub(a.fetched) < JWKSMinInterval {
+		a.mu.Unlock()
+		return nil // список только что запрошен другим запросом
+	}
+	a.fetched = now
+	a.mu.Unlock()
+	atomic.AddUint64(&a.stats.Fetches, 1)
+	data, ttl, err := fetchJWKS(a.url)
+	var keys map[string]interface{}
+	if err == nil {
+		keys, err = parseJWKS(data)
+	}
 	if err != nil {
+		atomic.AddUint64(&a.stats.Errors, 1)
+		a.mu.Lock()
+		a.stats.LastError = err.Error()
+		a.mu.Unlock()
 		return err
 	}
-	authKeys.jwkeys = keys // сохраняем список ключей
-	return keys[keyID]
+	a.mu.Lock()
+	a.jwkeys = keys
+	a.expires = now.Add(ttl)
+	a.negative = make(map[string]time.Time)
+	a.stats.LastError = ""
+	a.mu.Unlock()
+	// сохраняем список ключей для использования при запуске без доступа к
+	// провайдеру
+	if jwksStore != nil {
+		if err := jwksStore.save(sectionJWKS, a.url, string(data)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stale возвращает true, если время кеширования списка ключей истекло.
+func (a *Auth) Stale() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.jwkeys != nil && time.Now().After(a.expires)
+}
+
+// Stats возвращает статистику использования списка ключей.
+func (a *Auth) Stats() JWKSStats {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	var stats = JWKSStats{
+		Hits:         atomic.LoadUint64(&a.stats.Hits),
+		Misses:       atomic.LoadUint64(&a.stats.Misses),
+		NegativeHits: atomic.LoadUint64(&a.stats.NegativeHits),
+		Fetches:      atomic.LoadUint64(&a.stats.Fetches),
+		Errors:       atomic.LoadUint64(&a.stats.Errors),
+		Keys:         len(a.jwkeys),
+		LastError:    a.stats.LastError,
+	}
+	if !a.fetched.IsZero() {
+		var fetched = a.fetched.UTC()
+		stats.Fetched = &fetched
+	}
+	if !a.expires.IsZero() {
+		var expires = a.expires.UTC()
+		stats.Expires = &expires
+	}
+	return stats
 }
 
-// GetJWKeys запрашивает и разбирает список ключей.
-func GetJWKeys(url string) (map[string]interface{}, error) {
+// fetchJWKS запрашивает список ключей и возвращает его вместе со временем
+// кеширования, определенным по заголовку Cache-Control.
+func fetchJWKS(url string) ([]byte, time.Duration, error) {
 	// формируем запрос для получения ключей
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	req.Header.Set("User-Agent", app.Agent)
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return nil, rest.ErrServiceUnavailable // сервер провайдера ответил ошибкой
+		return nil, 0, rest.ErrServiceUnavailable // сервер провайдера ответил ошибкой
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	return data, cacheTTL(resp.Header.Get("Cache-Control")), nil
+}
+
+// cacheTTL возвращает время кеширования по значению max-age заголовка
+// Cache-Control, ограниченное значениями JWKSMinTTL и JWKSMaxTTL.
+func cacheTTL(header string) time.Duration {
+	var ttl = JWKSDefaultTTL
+	for _, directive := range strings.Split(header, ",") {
+		directive = strings.TrimSpace(strings.ToLower(directive))
+		if strings.HasPrefix(directive, "max-age=") {
+			if age, err := strconv.Atoi(directive[len("max-age="):]); err == nil {
+				ttl = time.Duration(age) * time.Second
+			}
+		}
+	}
+	if ttl < JWKSMinTTL {
+		ttl = JWKSMinTTL
 	}
-	// разбираем список полученных ключей
+	if ttl > JWKSMaxTTL {
+		ttl = JWKSMaxTTL
+	}
+	return ttl
+}
+
+// parseJWKS разбирает список ключей и возвращает их в виде словаря по их
+// идентификатору.
+func parseJWKS(data []byte) (map[string]interface{}, error) {
 	var jwkeys = new(struct {
 		Keys []*jwt.JWK `json:"keys"` // список ключей
 	})
-	err = json.NewDecoder(resp.Body).Decode(&jwkeys)
-	if err != nil {
+	if err := json.Unmarshal(data, jwkeys); err != nil {
 		return nil, err
 	}
-	// разбираем ключи и преобразуем их в словарь по их идентификатору
 	var result = make(map[string]interface{}, len(jwkeys.Keys))
 	for _, key := range jwkeys.Keys {
 		decodedKey, err := key.Decode()
@@ -78,3 +275,59 @@ func GetJWKeys(url string) (map[string]interface{}, error) {
 	}
 	return result, nil
 }
+
+// RefreshJWKS в фоне обновляет списки ключей, время кеширования которых
+// истекло.
+func RefreshJWKS(interval time.Duration) {
+	for range time.Tick(interval) {
+		jwksCachesMu.Lock()
+		var list = make([]*Auth, 0, len(jwksCaches))
+		for _, auth := range jwksCaches {
+			list = append(list, auth)
+		}
+		jwksCachesMu.Unlock()
+		for _, auth := range list {
+			if !auth.Stale() {
+				continue
+			}
+			if err := auth.refresh(); err != nil {
+				log.Warn("jwks refresh error", "url", auth.url, "error", err)
+			}
+		}
+	}
+}
+
+// LoadJWKS загружает из хранилища последние полученные списки ключей. Они
+// используются до тех пор, пока не будут получены актуальные.
+func (s *Store) LoadJWKS() error {
+	jwksStore = s
+	return s.db.View(func(tx *bolt.Tx) error {
+		var bucket = tx.Bucket([]byte(sectionJWKS))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			keys, err := parseJWKS(v)
+			if err != nil {
+				return nil // поврежденный список будет запрошен повторно
+			}
+			var auth = NewAuth(string(k))
+			auth.mu.Lock()
+			auth.jwkeys = keys
+			auth.expires = time.Now() // список требует обновления
+			auth.mu.Unlock()
+			return nil
+		})
+	})
+}
+
+// JWKS отдает статистику использования списков ключей.
+func (s *Store) JWKS(c *rest.Context) error {
+	jwksCachesMu.Lock()
+	var list = make(map[string]JWKSStats, len(jwksCaches))
+	for url, auth := range jwksCaches {
+		list[url] = auth.Stats()
+	}
+	jwksCachesMu.Unlock()
+	return c.Write(rest.JSON{"jwks": list})
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuthNegativeCache(t *testing.T) {
+	var auth = &Auth{url: "https://keys.test.com",
+		negative: make(map[string]time.Time)}
+	// список ключей только что получен, поэтому повторный запрос не
+	// выполняется, а неизвестный ключ кешируется только до следующего
+	// возможного запроса
+	var fetched = time.Now().Add(-JWKSMinInterval / 2)
+	auth.fetched = fetched
+	auth.jwkeys = map[string]interface{}{"known": "key"}
+	if key := auth.GetKey("", "known"); key != "key" {
+		t.Fatalf("bad key %v", key)
+	}
+	if err := auth.GetKey("", "new"); err != errUnknownKey {
+		t.Fatalf("unexpected result %v", err)
+	}
+	auth.mu.RLock()
+	var until = auth.negative["new"]
+	auth.mu.RUnlock()
+	if until.After(fetched.Add(JWKSMinInterval)) {
+		t.Fatalf("unknown key cached until %v, fetched %v", until, fetched)
+	}
+}
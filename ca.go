@@ -0,0 +1,489 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mdigger/rest"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Время действия сертификатов, выпускаемых встроенным удостоверяющим центром.
+var (
+	CAPeriod          = time.Hour * 24 * 365 * 10
+	CertificatePeriod = time.Hour * 24 * 365
+	CRLPeriod         = time.Hour * 24
+)
+
+// CAConfig описывает ключ и сертификат встроенного удостоверяющего центра.
+type CAConfig struct {
+	Certificate string `json:"certificate"` // сертификат в формате PEM
+	Key         string `json:"key"`         // закрытый ключ в формате PEM
+}
+
+// Certificate описывает выпущенный клиентский сертификат пользователя.
+type Certificate struct {
+	Serial  string     `json:"-"`                 // серийный номер
+	User    string     `json:"user"`              // идентификатор пользователя
+	Device  string     `json:"device,omitempty"`  // идентификатор устройства
+	Subject string     `json:"subject"`           // субъект сертификата
+	Issued  time.Time  `json:"issued"`            // время выпуска
+	Expires time.Time  `json:"expires"`           // время окончания действия
+	Revoked *time.Time `json:"revoked,omitempty"` // время отзыва
+	PEM     string     `json:"pem,omitempty"`     // сертификат в формате PEM
+}
+
+// authority содержит загруженный встроенный удостоверяющий центр и список
+// серийных номеров отозванных им сертификатов.
+var authority = struct {
+	cert    *x509.Certificate
+	key     crypto.Signer
+	pem     string
+	revoked map[string]time.Time
+	mu      sync.RWMutex
+}{}
+
+// errNoCA возвращается, если встроенный удостоверяющий центр не создан.
+var errNoCA = rest.NewError(http.StatusNotFound, "certificate authority is not configured")
+
+// LoadCA загружает из хранилища ключ и сертификат встроенного
+// удостоверяющего центра и список отозванных им сертификатов. Загрузка
+// должна выполняться до LoadClientCAs, чтобы сертификат удостоверяющего
+// центра попал в список доверенных.
+func (s *Store) LoadCA() error {
+	var config = new(CAConfig)
+	switch err := s.load(sectionConfig, "ca", config); err {
+	case nil:
+	case rest.ErrNotFound:
+		return nil
+	default:
+		return err
+	}
+	certs, err := parseCertificates([]byte(config.Certificate))
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode([]byte(config.Key))
+	if block == nil {
+		return errors.New("bad certificate authority key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return errors.New("bad certificate authority key")
+	}
+	var revoked = make(map[string]time.Time)
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		var bucket = tx.Bucket([]byte(sectionCerts))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var cert = new(Certificate)
+			if err := json.Unmarshal(v, cert); err != nil {
+				return err
+			}
+			if cert.Revoked != nil {
+				revoked[string(k)] = *cert.Revoked
+			}
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+	authority.mu.Lock()
+	authority.cert = certs[0]
+	authority.key = signer
+	authority.pem = config.Certificate
+	authority.revoked = revoked
+	authority.mu.Unlock()
+	return nil
+}
+
+// issuedRevoked возвращает true, если сертификат выпущен встроенным
+// удостоверяющим центром и отозван.
+func issuedRevoked(cert *x509.Certificate) bool {
+	authority.mu.RLock()
+	defer authority.mu.RUnlock()
+	if authority.cert == nil ||
+		string(cert.RawIssuer) != string(authority.cert.RawSubject) {
+		return false
+	}
+	_, ok := authority.revoked[cert.SerialNumber.String()]
+	return ok
+}
+
+// randomSerial возвращает случайный серийный номер сертификата.
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// GetCA отдает сертификат встроенного удостоверяющего центра.
+func (s *Store) GetCA(c *rest.Context) error {
+	authority.mu.RLock()
+	defer authority.mu.RUnlock()
+	if authority.cert == nil {
+		return errNoCA
+	}
+	return c.Write(rest.JSON{
+		"subject":     authority.cert.Subject.String(),
+		"serial":      authority.cert.SerialNumber.String(),
+		"expires":     authority.cert.NotAfter.UTC(),
+		"certificate": authority.pem,
+	})
+}
+
+// CreateCA создает новый ключ и сертификат встроенного удостоверяющего
+// центра. Ранее выпущенные сертификаты при этом становятся
+// недействительными.
+func (s *Store) CreateCA(c *rest.Context) error {
+	var params = new(struct {
+		Name string `json:"name"`
+	})
+	if err := c.Bind(params); err != nil {
+		return c.Error(http.StatusBadRequest, err.Error())
+	}
+	if params.Name == "" {
+		params.Name = appName + " CA"
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+	var now = time.Now()
+	var template = &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: params.Name},
+		NotBefore:             now.Add(-time.Minute * 5),
+		NotAfter:              now.Add(CAPeriod),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		MaxPathLenZero:        true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	var config = &CAConfig{
+		Certificate: string(pem.EncodeToMemory(
+			&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		Key: string(pem.EncodeToMemory(
+			&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})),
+	}
+	if err := s.save(sectionConfig, "ca", config); err != nil {
+		return err
+	}
+	if err := s.LoadCA(); err != nil {
+		return err
+	}
+	// список доверенных центров загружается заново, чтобы заменить в нем
+	// сертификат предыдущего встроенного центра
+	if err := s.LoadClientCAs(); err != nil {
+		return err
+	}
+	auditLog.Info("certificate authority created", "name", params.Name)
+	return s.GetCA(c)
+}
+
+// IssueCertificate выпускает клиентский сертификат для авторизованного
+// пользователя по запросу на сертификат (CSR) в формате PEM, переданному в
+// теле запроса. Субъект сертификата формируется по данным пользователя, а
+// из запроса используется только открытый ключ.
+func (s *Store) IssueCertificate(c *rest.Context) error {
+	user, err := s.AuthUser(c)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		return c.Error(http.StatusBadRequest, err.Error())
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return c.Error(http.StatusBadRequest, "certificate request required")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return c.Error(http.StatusBadRequest, err.Error())
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return c.Error(http.StatusBadRequest, err.Error())
+	}
+	authority.mu.RLock()
+	var caCert, caKey = authority.cert, authority.key
+	authority.mu.RUnlock()
+	if caCert == nil {
+		return errNoCA
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+	var now = time.Now()
+	var subject = pkix.Name{CommonName: user.Email}
+	var device = currentDevice(c)
+	if device != nil {
+		subject.OrganizationalUnit = []string{device.ID}
+	}
+	var template = &x509.Certificate{
+		SerialNumber:   serial,
+		Subject:        subject,
+		EmailAddresses: []string{user.Email},
+		NotBefore:      now.Add(-time.Minute * 5),
+		NotAfter:       now.Add(CertificatePeriod),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if template.NotAfter.After(caCert.NotAfter) {
+		template.NotAfter = caCert.NotAfter
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert,
+		csr.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	var cert = &Certificate{
+		Serial:  serial.String(),
+		User:    user.Email,
+		Subject: subject.String(),
+		Issued:  now.UTC(),
+		Expires: template.NotAfter.UTC(),
+		PEM: string(pem.EncodeToMemory(
+			&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+	}
+	if device != nil {
+		cert.Device = device.ID
+	}
+	if err := s.save(sectionCerts, cert.Serial, cert); err != nil {
+		return err
+	}
+	auditLog.Info("certificate issued", "user", cert.User, "device", cert.Device,
+		"serial", cert.Serial)
+	c.SetHeader("Content-Type", "application/x-pem-file")
+	return c.Write([]byte(cert.PEM))
+}
+
+// certificates возвращает список сертификатов пользователя.
+func (s *Store) certificates(email string) (map[string]*Certificate, error) {
+	var list = make(map[string]*Certificate)
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		var bucket = tx.Bucket([]byte(sectionCerts))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var cert = new(Certificate)
+			if err := json.Unmarshal(v, cert); err != nil {
+				return err
+			}
+			if cert.User == email {
+				cert.Serial = string(k)
+				list[string(k)] = cert
+			}
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// certConfig возвращает описание действующего сертификата пользователя или
+// его устройства для добавления в конфигурацию. Если встроенный
+// удостоверяющий центр не создан, то возвращается nil.
+func (s *Store) certConfig(user *User, device *Device) (rest.JSON, error) {
+	authority.mu.RLock()
+	var caPEM = authority.pem
+	authority.mu.RUnlock()
+	if caPEM == "" {
+		return nil, nil
+	}
+	var result = rest.JSON{"ca": caPEM}
+	list, err := s.certificates(user.Email)
+	if err != nil {
+		return nil, err
+	}
+	var now = time.Now()
+	var last *Certificate
+	for _, cert := range list {
+		if cert.Revoked != nil || now.After(cert.Expires) ||
+			(device != nil && cert.Device != device.ID) ||
+			(last != nil && !cert.Issued.After(last.Issued)) {
+			continue
+		}
+		last = cert
+	}
+	if last != nil {
+		result["serial"] = last.Serial
+		result["expires"] = last.Expires
+		result["certificate"] = last.PEM
+	}
+	return result, nil
+}
+
+// Certificates отдает список выпущенных сертификатов пользователя.
+func (s *Store) Certificates(c *rest.Context) error {
+	list, err := s.certificates(c.Param("name"))
+	if err != nil {
+		return err
+	}
+	for _, cert := range list {
+		cert.PEM = ""
+	}
+	return c.Write(rest.JSON{sectionCerts: list})
+}
+
+// RevokeCertificate отзывает выпущенный сертификат пользователя. Отозванный
+// сертификат включается в публикуемый список отозванных сертификатов.
+func (s *Store) RevokeCertificate(c *rest.Context) error {
+	var serial = c.Param("serial")
+	var now = time.Now().UTC()
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		var bucket = tx.Bucket([]byte(sectionCerts))
+		if bucket == nil {
+			return c.Error(http.StatusNotFound, "certificate not found")
+		}
+		var data = bucket.Get([]byte(serial))
+		if data == nil {
+			return c.Error(http.StatusNotFound, "certificate not found")
+		}
+		var cert = new(Certificate)
+		if err := json.Unmarshal(data, cert); err != nil {
+			return err
+		}
+		if cert.User != c.Param("name") {
+			return c.Error(http.StatusNotFound, "certificate not found")
+		}
+		if cert.Revoked != nil {
+			now = *cert.Revoked
+			return nil
+		}
+		cert.Revoked = &now
+		data, err := json.MarshalIndent(cert, "", "    ")
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(serial), data)
+	}); err != nil {
+		return err
+	}
+	authority.mu.Lock()
+	if authority.revoked != nil {
+		authority.revoked[serial] = now
+	}
+	authority.mu.Unlock()
+	auditLog.Info("certificate revoked", "user", c.Param("name"), "serial", serial)
+	return nil
+}
+
+// revokeCertificates отзывает в рамках транзакции все действующие
+// сертификаты пользователя или, если задан идентификатор, только его
+// устройства. Список отозванных сертификатов встроенного удостоверяющего
+// центра обновляется после успешного завершения транзакции.
+func revokeCertificates(tx *bolt.Tx, email, device string) error {
+	var bucket = tx.Bucket([]byte(sectionCerts))
+	if bucket == nil {
+		return nil
+	}
+	var list = make(map[string]*Certificate)
+	if err := bucket.ForEach(func(k, v []byte) error {
+		var cert = new(Certificate)
+		if err := json.Unmarshal(v, cert); err != nil {
+			return err
+		}
+		if cert.User == email && cert.Revoked == nil &&
+			(device == "" || cert.Device == device) {
+			list[string(k)] = cert
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if len(list) == 0 {
+		return nil
+	}
+	var now = time.Now().UTC()
+	for serial, cert := range list {
+		cert.Revoked = &now
+		data, err := json.MarshalIndent(cert, "", "    ")
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put([]byte(serial), data); err != nil {
+			return err
+		}
+	}
+	tx.OnCommit(func() {
+		authority.mu.Lock()
+		if authority.revoked != nil {
+			for serial := range list {
+				authority.revoked[serial] = now
+			}
+		}
+		authority.mu.Unlock()
+		for serial := range list {
+			auditLog.Info("certificate revoked", "user", email,
+				"device", list[serial].Device, "serial", serial)
+		}
+	})
+	return nil
+}
+
+// CRL отдает подписанный встроенным удостоверяющим центром список отозванных
+// сертификатов в формате DER.
+func (s *Store) CRL(c *rest.Context) error {
+	authority.mu.RLock()
+	var caCert, caKey = authority.cert, authority.key
+	var revoked = make([]pkix.RevokedCertificate, 0, len(authority.revoked))
+	for serial, date := range authority.revoked {
+		var number, ok = new(big.Int).SetString(serial, 10)
+		if !ok {
+			continue
+		}
+		revoked = append(revoked, pkix.RevokedCertificate{
+			SerialNumber:   number,
+			RevocationTime: date,
+		})
+	}
+	authority.mu.RUnlock()
+	if caCert == nil {
+		return errNoCA
+	}
+	var now = time.Now()
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:              big.NewInt(now.Unix()),
+		ThisUpdate:          now,
+		NextUpdate:          now.Add(CRLPeriod),
+		RevokedCertificates: revoked,
+	}, caCert, caKey)
+	if err != nil {
+		return err
+	}
+	c.SetHeader("Content-Type", "application/pkix-crl")
+	return c.Write(der)
+}
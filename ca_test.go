@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestRevokeCertificates(t *testing.T) {
+	var store = testStore(t)
+	for serial, cert := range map[string]*Certificate{
+		"1": {User: "user@test.com", Device: "phone"},
+		"2": {User: "user@test.com", Device: "laptop"},
+		"3": {User: "user@test.com"},
+		"4": {User: "other@test.com"},
+	} {
+		if err := store.save(sectionCerts, serial, cert); err != nil {
+			t.Fatal(err)
+		}
+	}
+	authority.mu.Lock()
+	authority.revoked = make(map[string]time.Time)
+	authority.mu.Unlock()
+	defer func() {
+		authority.mu.Lock()
+		authority.revoked = nil
+		authority.mu.Unlock()
+	}()
+	var revoked = func(list ...string) {
+		t.Helper()
+		for _, serial := range []string{"1", "2", "3", "4"} {
+			var want bool
+			for _, name := range list {
+				want = want || name == serial
+			}
+			var cert = new(Certificate)
+			if err := store.load(sectionCerts, serial, cert); err != nil {
+				t.Fatal(err)
+			}
+			authority.mu.RLock()
+			_, crl := authority.revoked[serial]
+			authority.mu.RUnlock()
+			if (cert.Revoked != nil) != want || crl != want {
+				t.Errorf("certificate %s: revoked %v, in crl %v", serial,
+					cert.Revoked != nil, crl)
+			}
+		}
+	}
+	if err := store.db.Update(func(tx *bolt.Tx) error {
+		return revokeCertificates(tx, "user@test.com", "phone")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	revoked("1")
+	// при откате транзакции список отозванных сертификатов не изменяется
+	var errRollback = errors.New("rollback")
+	if err := store.db.Update(func(tx *bolt.Tx) error {
+		if err := revokeCertificates(tx, "user@test.com", ""); err != nil {
+			return err
+		}
+		return errRollback
+	}); err != errRollback {
+		t.Fatal(err)
+	}
+	revoked("1")
+	for _, email := range []string{"user@test.com", "other@test.com"} {
+		if err := store.save(sectionUsers, email, &User{Email: email}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.db.Update(func(tx *bolt.Tx) error {
+		return renameUser(tx, "user@test.com", "new@test.com")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	revoked("1", "2", "3")
+	if err := store.db.Update(func(tx *bolt.Tx) error {
+		return removeUser(tx, "other@test.com", false)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	revoked("1", "2", "3", "4")
+}
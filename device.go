@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mdigger/rest"
+	bolt "go.etcd.io/bbolt"
+)
+
+// deviceTokenPrefix задает префикс ключей устройств, по которому они
+// отличаются от других токенов.
+const deviceTokenPrefix = "dev."
+
+// Device описывает устройство пользователя, получившее собственный ключ для
+// доступа к конфигурации. Сам ключ не сохраняется — хранится только его хеш.
+type Device struct {
+	ID       string     `json:"-"`                  // идентификатор устройства
+	User     string     `json:"user"`               // идентификатор пользователя
+	Hash     string     `json:"hash,omitempty"`     // хеш секретной части ключа
+	Name     string     `json:"name,omitempty"`     // название устройства
+	Platform string     `json:"platform,omitempty"` // платформа
+	Version  string     `json:"version,omitempty"`  // версия приложения
+	Created  time.Time  `json:"created"`            // время регистрации
+	LastSeen *time.Time `json:"lastSeen,omitempty"` // время последнего обращения
+	// параметры сервисов, переопределяемые для устройства
+	Services map[string]rest.JSON `json:"services,omitempty"`
+}
+
+// Заголовки запроса с информацией об устройстве пользователя.
+const (
+	headerPlatform = "X-Platform"    // платформа устройства
+	headerVersion  = "X-App-Version" // версия приложения
+	headerDevice   = "X-Device"      // идентификатор устройства
+)
+
+type deviceKey struct{} // ключ контекста с описанием устройства
+
+// currentDevice возвращает описание устройства, ключ которого использовался
+// для авторизации пользователя.
+func currentDevice(c *rest.Context) *Device {
+	device, _ := c.Request.Context().Value(deviceKey{}).(*Device)
+	return device
+}
+
+// newDevice регистрирует новое устройство пользователя в рамках транзакции и
+// возвращает его ключ.
+func newDevice(tx *bolt.Tx, device *Device) (string, error) {
+	var data = make([]byte, 40)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	device.ID = hex.EncodeToString(data[:8])
+	var secret = base64.RawURLEncoding.EncodeToString(data[8:])
+	device.Hash = hashAPIKey(secret)
+	device.Created = time.Now().UTC()
+	bucket, err := tx.CreateBucketIfNotExists([]byte(sectionDevices))
+	if err != nil {
+		return "", err
+	}
+	value, err := json.MarshalIndent(device, "", "    ")
+	if err != nil {
+		return "", err
+	}
+	if err := bucket.Put([]byte(device.ID), value); err != nil {
+		return "", err
+	}
+	return deviceTokenPrefix + device.ID + "." + secret, nil
+}
+
+// Device проверяет ключ устройства и возвращает его описание.
+func (s *Store) Device(token string) (*Device, error) {
+	var parts = strings.SplitN(strings.TrimPrefix(token, deviceTokenPrefix), ".", 2)
+	if len(parts) != 2 {
+		return nil, rest.NewError(http.StatusForbidden, "bad device key")
+	}
+	var device = &Device{ID: parts[0]}
+	switch err := s.load(sectionDevices, parts[0], device); err {
+	case nil:
+	case rest.ErrNotFound:
+		return nil, rest.NewError(http.StatusForbidden, "bad device key")
+	default:
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(device.Hash),
+		[]byte(hashAPIKey(parts[1]))) != 1 {
+		return nil, rest.NewError(http.StatusForbidden, "bad device key")
+	}
+	return device, nil
+}
+
+// touchDevice сохраняет время последнего обращения устройства, а также
+// платформу и версию приложения из заголовков запроса. Чтобы не записывать
+// данные при каждом запросе, время обновляется не чаще раза в минуту.
+func (s *Store) touchDevice(c *rest.Context, device *Device) error {
+	var now = time.Now().UTC()
+	var changed = device.LastSeen == nil || now.Sub(*device.LastSeen) >= time.Minute
+	if platform := c.Header(headerPlatform); platform != "" && platform != device.Platform {
+		device.Platform, changed = platform, true
+	}
+	if version := c.Header(headerVersion); version != "" && version != device.Version {
+		device.Version, changed = version, true
+	}
+	if !changed {
+		return nil
+	}
+	device.LastSeen = &now
+	data, err := json.MarshalIndent(device, "", "    ")
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		var bucket = tx.Bucket([]byte(sectionDevices))
+		// устройство могло быть отключено во время выполнения запроса
+		if bucket == nil || bucket.Get([]byte(device.ID)) == nil {
+			return nil
+		}
+		return bucket.Put([]byte(device.ID), data)
+	})
+}
+
+// requestDevice возвращает устройство пользователя и его платформу для
+// выбора параметров конфигурации. Устройство определяется по ключу,
+// использованному для авторизации, или по заголовку X-Device, а платформа —
+// по описанию устройства или заголовку X-Platform.
+func (s *Store) requestDevice(c *rest.Context, user *User) (*Device, string, error) {
+	var device = currentDevice(c)
+	if id := c.Header(headerDevice); device == nil && id != "" {
+		device = &Device{ID: id}
+		switch err := s.load(sectionDevices, id, device); {
+		case err == rest.ErrNotFound || (err == nil && device.User != user.Email):
+			device = nil // чужие и неизвестные устройства игнорируются
+		case err != nil:
+			return nil, "", err
+		}
+	}
+	var platform = c.Header(headerPlatform)
+	if device != nil && device.Platform != "" {
+		platform = device.Platform
+	}
+	return device, platform, nil
+}
+
+// Devices отдает список устройств пользователя без их ключей.
+func (s *Store) Devices(c *rest.Context) error {
+	var name = c.Param("name")
+	var list = make(map[string]*Device)
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		var bucket = tx.Bucket([]byte(sectionDevices))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var device = new(Device)
+			if err := json.Unmarshal(v, device); err != nil {
+				return err
+			}
+			if device.User == name {
+				device.Hash = ""
+				list[string(k)] = device
+			}
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+	return c.Write(rest.JSON{sectionDevices: list})
+}
+
+// UpdateDevice задает название устройства пользователя и переопределяемые
+// для него параметры сервисов.
+func (s *Store) UpdateDevice(c *rest.Context) error {
+	var params = new(struct {
+		Name     string               `json:"name"`
+		Services map[string]rest.JSON `json:"services"`
+	})
+	if err := c.Bind(params); err != nil {
+		return c.Error(http.StatusBadRequest, err.Error())
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		var bucket = tx.Bucket([]byte(sectionDevices))
+		if bucket == nil {
+			return c.Error(http.StatusNotFound, "device not found")
+		}
+		var id = c.Param("id")
+		var data = bucket.Get([]byte(id))
+		if data == nil {
+			return c.Error(http.StatusNotFound, "device not found")
+		}
+		var device = new(Device)
+		if err := json.Unmarshal(data, device); err != nil {
+			return err
+		}
+		if device.User != c.Param("name") {
+			return c.Error(http.StatusNotFound, "device not found")
+		}
+		device.Name = params.Name
+		device.Services = params.Services
+		data, err := json.MarshalIndent(device, "", "    ")
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(id), data)
+	})
+}
+
+// RemoveDevice отключает устройство пользователя. Ключ устройства после
+// этого становится недействительным.
+func (s *Store) RemoveDevice(c *rest.Context) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		var bucket = tx.Bucket([]byte(sectionDevices))
+		if bucket == nil {
+			return c.Error(http.StatusNotFound, "device not found")
+		}
+		var id = c.Param("id")
+		var data = bucket.Get([]byte(id))
+		if data == nil {
+			return c.Error(http.StatusNotFound, "device not found")
+		}
+		var device = new(Device)
+		if err := json.Unmarshal(data, device); err != nil {
+			return err
+		}
+		if device.User != c.Param("name") {
+			return c.Error(http.StatusNotFound, "device not found")
+		}
+		if err := revokeCertificates(tx, device.User, id); err != nil {
+			return err
+		}
+		auditLog.Info("device removed", "user", device.User, "device", id)
+		return bucket.Delete([]byte(id))
+	})
+}
+
+// moveDevices переносит устройства пользователя под новый идентификатор в
+// рамках транзакции. Если новый идентификатор не задан, то устройства
+// удаляются.
+func moveDevices(tx *bolt.Tx, from, to string) error {
+	var bucket = tx.Bucket([]byte(sectionDevices))
+	if bucket == nil {
+		return nil
+	}
+	var list = make(map[string]*Device)
+	if err := bucket.ForEach(func(k, v []byte) error {
+		var device = new(Device)
+		if err := json.Unmarshal(v, device); err != nil {
+			return err
+		}
+		if device.User == from {
+			list[string(k)] = device
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for id, device := range list {
+		if to == "" {
+			if err := bucket.Delete([]byte(id)); err != nil {
+				return err
+			}
+			continue
+		}
+		device.User = to
+		data, err := json.MarshalIndent(device, "", "    ")
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put([]byte(id), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mdigger/rest"
+	bolt "go.etcd.io/bbolt"
+)
+
+// EnrollmentPeriod определяет время действия кода для подключения устройства
+// по умолчанию.
+var EnrollmentPeriod = time.Hour * 72
+
+// PublicURL задает внешний адрес пользовательского сервера, используемый для
+// формирования ссылок.
+var PublicURL string
+
+// Enrollment описывает одноразовый код для подключения нового устройства
+// пользователя. Сам код не сохраняется — в качестве ключа используется его
+// хеш.
+type Enrollment struct {
+	User    string    `json:"user"`    // идентификатор пользователя
+	Created time.Time `json:"created"` // время создания
+	Expires time.Time `json:"expires"` // время окончания действия
+}
+
+// newEnrollmentCode возвращает новый случайный код для подключения
+// устройства. Код состоит из заглавных букв и цифр без похожих по написанию
+// символов, чтобы его было удобно вводить вручную.
+func newEnrollmentCode() (string, error) {
+	const dictionary = "23456789ABCDEFGHJKLMNPQRSTUVWXYZ"
+	var data = make([]byte, 16)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	for i, b := range data {
+		data[i] = dictionary[b%byte(len(dictionary))]
+	}
+	return strings.Join([]string{string(data[:4]), string(data[4:8]),
+		string(data[8:12]), string(data[12:])}, "-"), nil
+}
+
+// normalizeEnrollmentCode приводит введенный пользователем код к
+// каноническому виду.
+func normalizeEnrollmentCode(code string) string {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	if len(code) != 16 {
+		return code
+	}
+	return strings.Join([]string{code[:4], code[4:8], code[8:12], code[12:]}, "-")
+}
+
+// removeEnrollments удаляет все коды для подключения устройств пользователя,
+// а также коды, время действия которых истекло.
+func removeEnrollments(tx *bolt.Tx, email string) error {
+	var bucket = tx.Bucket([]byte(sectionEnroll))
+	if bucket == nil {
+		return nil
+	}
+	var now = time.Now()
+	var keys [][]byte
+	if err := bucket.ForEach(func(k, v []byte) error {
+		var enrollment = new(Enrollment)
+		if err := json.Unmarshal(v, enrollment); err != nil {
+			return err
+		}
+		if enrollment.User == email || now.After(enrollment.Expires) {
+			keys = append(keys, k)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := bucket.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateEnrollment создает одноразовый код для подключения нового устройства
+// пользователя и отдает его вместе со ссылкой и содержимым QR-кода. Если в
+// запросе указан флаг notify, то ссылка отправляется пользователю с
+// использованием шаблона enrollDevice.
+func (s *Store) CreateEnrollment(c *rest.Context) error {
+	var params = new(struct {
+		Expires *time.Time `json:"expires"`
+		Notify  bool       `json:"notify"`
+	})
+	if err := c.Bind(params); err != nil {
+		return c.Error(http.StatusBadRequest, err.Error())
+	}
+	user, err := s.User(c.Param("name"))
+	if err == rest.ErrNotFound {
+		return c.Error(http.StatusNotFound, "user not found")
+	}
+	if err != nil {
+		return err
+	}
+	var now = time.Now()
+	var enrollment = &Enrollment{
+		User:    user.Email,
+		Created: now.UTC(),
+		Expires: now.Add(EnrollmentPeriod).UTC(),
+	}
+	if params.Expires != nil {
+		if !params.Expires.After(now) {
+			return c.Error(http.StatusBadRequest, "bad enrollment expiration")
+		}
+		enrollment.Expires = params.Expires.UTC()
+	}
+	code, err := newEnrollmentCode()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(enrollment, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		// заодно удаляем коды, время действия которых истекло
+		if err := removeEnrollments(tx, ""); err != nil {
+			return err
+		}
+		bucket, err := tx.CreateBucketIfNotExists([]byte(sectionEnroll))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(hashAPIKey(code)), data)
+	}); err != nil {
+		return err
+	}
+	var link = "/enroll/" + url.PathEscape(code)
+	if PublicURL != "" {
+		link = strings.TrimSuffix(PublicURL, "/") + link
+	}
+	qr, err := json.Marshal(rest.JSON{"server": PublicURL, "code": code})
+	if err != nil {
+		return err
+	}
+	var result = rest.JSON{
+		"code":    code,
+		"link":    link,
+		"qr":      string(qr),
+		"expires": enrollment.Expires,
+	}
+	if params.Notify {
+		if err := s.Send(user, "enrollDevice", rest.JSON{
+			"code":    code,
+			"link":    link,
+			"expires": enrollment.Expires,
+		}); err != nil {
+			return err
+		}
+	}
+	return c.Write(result)
+}
+
+// Enroll подключает новое устройство пользователя по одноразовому коду и
+// отдает ключ устройства, который используется для авторизации вместо
+// пароля пользователя. Код может быть использован только один раз.
+func (s *Store) Enroll(c *rest.Context) error {
+	var ip = clientIP(c.Request)
+	if wait := authAttempts.Wait("", ip); wait > 0 {
+		return tooManyRequests(c, wait)
+	}
+	var code = normalizeEnrollmentCode(c.Param("code"))
+	var device = new(Device)
+	var token string
+	var failure error // ошибка, при которой код все равно считается использованным
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		var bucket = tx.Bucket([]byte(sectionEnroll))
+		if bucket == nil {
+			return rest.ErrNotFound
+		}
+		var key = []byte(hashAPIKey(code))
+		var data = bucket.Get(key)
+		if data == nil {
+			return rest.ErrNotFound
+		}
+		// код одноразовый и удаляется при любой попытке использования
+		if err := bucket.Delete(key); err != nil {
+			return err
+		}
+		var enrollment = new(Enrollment)
+		if err := json.Unmarshal(data, enrollment); err != nil {
+			return err
+		}
+		if time.Now().After(enrollment.Expires) {
+			failure = rest.NewError(http.StatusNotFound, "enrollment code expired")
+			return nil
+		}
+		c.AddLogField("user", enrollment.User)
+		var users = tx.Bucket([]byte(sectionUsers))
+		if users == nil {
+			return rest.ErrNotFound
+		}
+		data = users.Get([]byte(enrollment.User))
+		if data == nil {
+			return rest.ErrNotFound
+		}
+		var user = &User{Email: enrollment.User}
+		if err := json.Unmarshal(data, user); err != nil {
+			return err
+		}
+		if failure = user.Check(); failure != nil {
+			return nil
+		}
+		device.User = user.Email
+		device.Platform = c.Header(headerPlatform)
+		device.Version = c.Header(headerVersion)
+		var err error
+		token, err = newDevice(tx, device)
+		return err
+	}); err == rest.ErrNotFound {
+		authAttempts.Fail("", ip)
+		return c.Error(http.StatusNotFound, "bad enrollment code")
+	} else if err != nil {
+		return err
+	}
+	if failure != nil {
+		return failure
+	}
+	auditLog.Info("device enrolled", "user", device.User, "device", device.ID,
+		"ip", ip)
+	return c.Write(rest.JSON{
+		"key":    token,
+		"type":   "Bearer",
+		"device": device.ID,
+	})
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"net/http"
 	"sync"
@@ -66,9 +67,23 @@ func (s *Store) GmailClient() (*gmail.Service, error) {
 	return service, nil
 }
 
+// gmailMailer отправляет почтовые сообщения с помощью Gmail API.
+type gmailMailer struct {
+	service *gmail.Service
+}
+
+// Send отправляет сообщение. Адрес получателя берется из заголовков
+// сообщения.
+func (m *gmailMailer) Send(to string, message []byte) error {
+	_, err := m.service.Users.Messages.Send("me", &gmail.Message{
+		Raw: base64.RawURLEncoding.EncodeToString(message),
+	}).Do()
+	return err
+}
+
 // Send отсылает пользователю почтовое сообщение, используя шаблон.
 func (s *Store) Send(user *User, templateName string, data rest.JSON) error {
-	client, err := s.GmailClient()
+	mailer, from, err := s.Mailer()
 	if err != nil {
 		return err
 	}
@@ -78,7 +93,7 @@ func (s *Store) Send(user *User, templateName string, data rest.JSON) error {
 	}
 	data["email"] = user.Email
 	data["name"] = user.Name
-	return template.Send(client, user.Email, data)
+	return template.Send(mailer, from, user.Email, data)
 }
 
 // SendWithTemplate отсылает письмо пользователю с помощью шаблона.
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Hasher описывает алгоритм хеширования паролей.
+type Hasher interface {
+	// Hash возвращает хеш пароля.
+	Hash(password []byte) ([]byte, error)
+	// Verify возвращает true, если пароль соответствует хешу.
+	Verify(hash, password []byte) bool
+	// Outdated возвращает true, если хеш получен с помощью другого алгоритма
+	// или с другими параметрами и его нужно пересчитать.
+	Outdated(hash []byte) bool
+}
+
+// DefaultHasher задает алгоритм, используемый для хеширования новых паролей.
+var DefaultHasher Hasher = &BcryptHasher{Cost: bcrypt.DefaultCost}
+
+// Максимальные значения параметров хеширования. Хеши с большими значениями
+// не проверяются, чтобы сохраненный хеш не мог потребовать от сервера
+// неограниченных ресурсов.
+const (
+	maxArgon2Memory = 1 << 20 // объем памяти argon2id в KiB (1 GiB)
+	maxArgon2Time   = 16      // количество итераций argon2id
+	maxScryptMemory = 1 << 30 // объем памяти scrypt в байтах (128·r·N)
+	maxScryptP      = 16      // параллелизм scrypt
+	maxHashLen      = 64      // длина хеша
+)
+
+// validArgon2 возвращает true, если параметры argon2id не выходят за
+// допустимые пределы.
+func validArgon2(memory, time, threads int) bool {
+	return memory >= 1 && memory <= maxArgon2Memory &&
+		time >= 1 && time <= maxArgon2Time &&
+		threads >= 1 && threads <= 255
+}
+
+// validScrypt возвращает true, если параметры scrypt не выходят за
+// допустимые пределы.
+func validScrypt(logN, r, p int) bool {
+	return logN >= 1 && logN <= 30 && r >= 1 && p >= 1 && p <= maxScryptP &&
+		r <= maxScryptMemory>>uint(logN)/128
+}
+
+// ParseHasher возвращает алгоритм хеширования по его описанию. Описание
+// состоит из названия алгоритма и, необязательно, списка параметров через
+// двоеточие: `bcrypt:cost=12`, `argon2id:m=65536,t=3,p=2` или
+// `scrypt:ln=15,r=8,p=1`. Не указанные параметры принимают значения по
+// умолчанию.
+func ParseHasher(spec string) (Hasher, error) {
+	var name, params = spec, ""
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		name, params = spec[:i], spec[i+1:]
+	}
+	values, err := parseParams(params)
+	if err != nil {
+		return nil, err
+	}
+	switch name {
+	case "bcrypt":
+		var h = &BcryptHasher{Cost: bcrypt.DefaultCost}
+		if v, ok := values["cost"]; ok {
+			h.Cost = v
+		}
+		if h.Cost < bcrypt.MinCost || h.Cost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bad bcrypt cost %d", h.Cost)
+		}
+		return h, nil
+	case "argon2id":
+		var h = NewArgon2Hasher()
+		var memory, time, threads = int(h.Memory), int(h.Time), int(h.Threads)
+		if v, ok := values["m"]; ok {
+			memory = v
+		}
+		if v, ok := values["t"]; ok {
+			time = v
+		}
+		if v, ok := values["p"]; ok {
+			threads = v
+		}
+		if !validArgon2(memory, time, threads) {
+			return nil, fmt.Errorf("bad argon2id parameters %q", params)
+		}
+		h.Memory, h.Time, h.Threads = uint32(memory), uint32(time), uint8(threads)
+		return h, nil
+	case "scrypt":
+		var h = NewScryptHasher()
+		if v, ok := values["ln"]; ok {
+			h.LogN = v
+		}
+		if v, ok := values["r"]; ok {
+			h.R = v
+		}
+		if v, ok := values["p"]; ok {
+			h.P = v
+		}
+		if !validScrypt(h.LogN, h.R, h.P) {
+			return nil, fmt.Errorf("bad scrypt parameters %q", params)
+		}
+		return h, nil
+	default:
+		return nil, fmt.Errorf("unsupported password hash %q", name)
+	}
+}
+
+// parseParams разбирает список числовых параметров в формате PHC:
+// `m=65536,t=3,p=2`.
+func parseParams(params string) (map[string]int, error) {
+	var result = make(map[string]int)
+	if params == "" {
+		return result, nil
+	}
+	for _, param := range strings.Split(params, ",") {
+		var i = strings.IndexByte(param, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("bad hash parameter %q", param)
+		}
+		value, err := strconv.Atoi(param[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("bad hash parameter %q", param)
+		}
+		result[param[:i]] = value
+	}
+	return result, nil
+}
+
+// phc описывает разобранный хеш в формате PHC:
+// `$<id>[$v=<version>]$<params>$<salt>$<hash>`.
+type phc struct {
+	id     string
+	params map[string]int
+	salt   []byte
+	hash   []byte
+}
+
+// parsePHC разбирает хеш в формате PHC.
+func parsePHC(data []byte) (*phc, error) {
+	var parts = strings.Split(string(data), "$")
+	if len(parts) == 6 && strings.HasPrefix(parts[2], "v=") {
+		parts = append(parts[:2], parts[3:]...) // версию не проверяем
+	}
+	if len(parts) != 5 || parts[0] != "" {
+		return nil, fmt.Errorf("bad hash format")
+	}
+	params, err := parseParams(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return nil, err
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, err
+	}
+	return &phc{id: parts[1], params: params, salt: salt, hash: hash}, nil
+}
+
+// salt возвращает случайную соль указанной длины.
+func salt(size int) ([]byte, error) {
+	var salt = make([]byte, size)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// hasherFor возвращает алгоритм, с помощью которого был получен хеш, или nil,
+// если хеш не поддерживается.
+func hasherFor(hash []byte) Hasher {
+	if _, err := bcrypt.Cost(hash); err == nil {
+		return new(BcryptHasher)
+	}
+	var h, err = parsePHC(hash)
+	if err != nil {
+		return nil
+	}
+	switch h.id {
+	case "argon2id":
+		return new(Argon2Hasher)
+	case "scrypt":
+		return new(ScryptHasher)
+	default:
+		return nil
+	}
+}
+
+// BcryptHasher хеширует пароли с помощью bcrypt.
+type BcryptHasher struct {
+	Cost int // сложность
+}
+
+// Hash возвращает bcrypt-хеш пароля.
+func (h *BcryptHasher) Hash(password []byte) ([]byte, error) {
+	return bcrypt.GenerateFromPassword(password, h.Cost)
+}
+
+// Verify возвращает true, если пароль соответствует bcrypt-хешу.
+func (h *BcryptHasher) Verify(hash, password []byte) bool {
+	return bcrypt.CompareHashAndPassword(hash, password) == nil
+}
+
+// Outdated возвращает true, если хеш не является bcrypt-хешем с заданной
+// сложностью.
+func (h *BcryptHasher) Outdated(hash []byte) bool {
+	cost, err := bcrypt.Cost(hash)
+	return err != nil || cost != h.Cost
+}
+
+// Argon2Hasher хеширует пароли с помощью argon2id.
+type Argon2Hasher struct {
+	Memory  uint32 // объем памяти в KiB
+	Time    uint32 // количество итераций
+	Threads uint8  // количество потоков
+	KeyLen  uint32 // длина хеша
+	SaltLen int    // длина соли
+}
+
+// NewArgon2Hasher возвращает Argon2Hasher с параметрами по умолчанию.
+func NewArgon2Hasher() *Argon2Hasher {
+	return &Argon2Hasher{Memory: 64 * 1024, Time: 3, Threads: 2,
+		KeyLen: 32, SaltLen: 16}
+}
+
+// Hash возвращает хеш пароля argon2id в формате PHC.
+func (h *Argon2Hasher) Hash(password []byte) ([]byte, error) {
+	salt, err := salt(h.SaltLen)
+	if err != nil {
+		return nil, err
+	}
+	var key = argon2.IDKey(password, salt, h.Time, h.Memory, h.Threads, h.KeyLen)
+	return []byte(fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Memory, h.Time, h.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key))), nil
+}
+
+// Verify возвращает true, если пароль соответствует хешу argon2id. Параметры
+// вычисления берутся из самого хеша и не должны превышать допустимых
+// значений.
+func (h *Argon2Hasher) Verify(hash, password []byte) bool {
+	p, err := parsePHC(hash)
+	if err != nil || p.id != "argon2id" ||
+		len(p.hash) == 0 || len(p.hash) > maxHashLen ||
+		!validArgon2(p.params["m"], p.params["t"], p.params["p"]) {
+		return false
+	}
+	var key = argon2.IDKey(password, p.salt, uint32(p.params["t"]),
+		uint32(p.params["m"]), uint8(p.params["p"]), uint32(len(p.hash)))
+	return subtle.ConstantTimeCompare(key, p.hash) == 1
+}
+
+// Outdated возвращает true, если хеш не является хешем argon2id с заданными
+// параметрами.
+func (h *Argon2Hasher) Outdated(hash []byte) bool {
+	p, err := parsePHC(hash)
+	return err != nil || p.id != "argon2id" ||
+		p.params["m"] != int(h.Memory) || p.params["t"] != int(h.Time) ||
+		p.params["p"] != int(h.Threads) || len(p.hash) != int(h.KeyLen)
+}
+
+// ScryptHasher хеширует пароли с помощью scrypt.
+type ScryptHasher struct {
+	LogN    int // двоичный логарифм сложности
+	R       int // размер блока
+	P       int // параллелизм
+	KeyLen  int // длина хеша
+	SaltLen int // длина соли
+}
+
+// NewScryptHasher возвращает ScryptHasher с параметрами по умолчанию.
+func NewScryptHasher() *ScryptHasher {
+	return &ScryptHasher{LogN: 15, R: 8, P: 1, KeyLen: 32, SaltLen: 16}
+}
+
+// Hash возвращает хеш пароля scrypt в формате PHC.
+func (h *ScryptHasher) Hash(password []byte) ([]byte, error) {
+	salt, err := salt(h.SaltLen)
+	if err != nil {
+		return nil, err
+	}
+	key, err := scrypt.Key(password, salt, 1<<uint(h.LogN), h.R, h.P, h.KeyLen)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s",
+		h.LogN, h.R, h.P,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key))), nil
+}
+
+// Verify возвращает true, если пароль соответствует хешу scrypt. Параметры
+// вычисления берутся из самого хеша и не должны превышать допустимых
+// значений.
+func (h *ScryptHasher) Verify(hash, password []byte) bool {
+	p, err := parsePHC(hash)
+	if err != nil || p.id != "scrypt" ||
+		len(p.hash) == 0 || len(p.hash) > maxHashLen ||
+		!validScrypt(p.params["ln"], p.params["r"], p.params["p"]) {
+		return false
+	}
+	key, err := scrypt.Key(password, p.salt, 1<<uint(p.params["ln"]),
+		p.params["r"], p.params["p"], len(p.hash))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(key, p.hash) == 1
+}
+
+// Outdated возвращает true, если хеш не является хешем scrypt с заданными
+// параметрами.
+func (h *ScryptHasher) Outdated(hash []byte) bool {
+	p, err := parsePHC(hash)
+	return err != nil || p.id != "scrypt" ||
+		p.params["ln"] != h.LogN || p.params["r"] != h.R ||
+		p.params["p"] != h.P || len(p.hash) != h.KeyLen
+}
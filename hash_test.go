@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHashers(t *testing.T) {
+	for _, spec := range []string{
+		"bcrypt:cost=4",
+		"argon2id:m=1024,t=1,p=1",
+		"scrypt:ln=10,r=8,p=1",
+	} {
+		hasher, err := ParseHasher(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash, err := hasher.Hash([]byte("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !hasher.Verify(hash, []byte("secret")) || hasher.Verify(hash, []byte("wrong")) {
+			t.Errorf("%s: verify failed", spec)
+		}
+		if hasher.Outdated(hash) {
+			t.Errorf("%s: fresh hash is outdated", spec)
+		}
+		if hasherFor(hash) == nil {
+			t.Errorf("%s: hash not recognized", spec)
+		}
+	}
+}
+
+func TestParseHasherLimits(t *testing.T) {
+	for _, spec := range []string{
+		"bcrypt:cost=40",
+		"argon2id:m=0",
+		"argon2id:m=4294967296",
+		"argon2id:t=17",
+		"argon2id:p=256",
+		"scrypt:ln=31",
+		"scrypt:ln=20,r=16",
+		"scrypt:p=17",
+		"md5",
+	} {
+		if _, err := ParseHasher(spec); err == nil {
+			t.Errorf("%s: accepted", spec)
+		}
+	}
+}
+
+func TestVerifyLimits(t *testing.T) {
+	// параметры хешей превышают допустимые значения: проверка должна
+	// завершаться неудачей сразу, без вычисления хеша
+	const salt, key = "c2FsdHNhbHRzYWx0c2FsdA", "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+	for _, hash := range []string{
+		fmt.Sprintf("$argon2id$v=19$m=%d,t=1,p=1$%s$%s", maxArgon2Memory+1, salt, key),
+		fmt.Sprintf("$argon2id$v=19$m=1024,t=%d,p=1$%s$%s", 1<<30, salt, key),
+		fmt.Sprintf("$scrypt$ln=30,r=8,p=1$%s$%s", salt, key),
+		fmt.Sprintf("$scrypt$ln=10,r=1048576,p=1$%s$%s", salt, key),
+		fmt.Sprintf("$scrypt$ln=10,r=8,p=1000$%s$%s", salt, key),
+	} {
+		if hasherFor([]byte(hash)).Verify([]byte(hash), []byte("secret")) {
+			t.Errorf("%s: verified", hash)
+		}
+	}
+}
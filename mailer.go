@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mdigger/rest"
+)
+
+// Mailer описывает способ доставки почтовых сообщений.
+type Mailer interface {
+	// Send отправляет сообщение, уже содержащее все заголовки, на указанный
+	// адрес.
+	Send(to string, message []byte) error
+}
+
+// Способы доставки почтовых сообщений.
+const (
+	transportGmail   = "gmail"   // Gmail API
+	transportSMTP    = "smtp"    // почтовый сервер SMTP
+	transportFile    = "file"    // файлы в каталоге
+	transportMaildir = "maildir" // каталог в формате Maildir
+)
+
+// Способы защиты соединения с почтовым сервером.
+const (
+	securitySTARTTLS = "starttls" // команда STARTTLS (по умолчанию)
+	securityTLS      = "tls"      // соединение сразу по TLS
+	securityNone     = "none"     // без шифрования
+)
+
+// MailConfig описывает настройки доставки почтовых сообщений. Если способ
+// доставки не задан, то используется Gmail API.
+type MailConfig struct {
+	Transport string `json:"transport"`          // способ доставки
+	From      string `json:"from,omitempty"`     // адрес отправителя
+	Host      string `json:"host,omitempty"`     // адрес сервера SMTP
+	Port      int    `json:"port,omitempty"`     // порт сервера SMTP
+	Security  string `json:"security,omitempty"` // защита соединения
+	Auth      string `json:"auth,omitempty"`     // способ авторизации: plain или login
+	Username  string `json:"username,omitempty"` // имя пользователя
+	Password  string `json:"password,omitempty"` // пароль
+	Path      string `json:"path,omitempty"`     // каталог для file и maildir
+}
+
+// Mailer возвращает настроенный способ доставки почтовых сообщений и адрес
+// отправителя.
+func (s *Store) Mailer() (Mailer, string, error) {
+	var config = new(MailConfig)
+	if err := s.load(sectionConfig, "mail", config); err != nil &&
+		err != rest.ErrNotFound {
+		return nil, "", err
+	}
+	switch config.Transport {
+	case "", transportGmail:
+		service, err := s.GmailClient()
+		if err != nil {
+			return nil, "", err
+		}
+		return &gmailMailer{service: service}, config.From, nil
+	case transportSMTP:
+		return &smtpMailer{config: config}, config.From, nil
+	case transportFile, transportMaildir:
+		return &fileMailer{path: config.Path,
+			maildir: config.Transport == transportMaildir}, config.From, nil
+	default:
+		return nil, "", fmt.Errorf("unknown mail transport %s", config.Transport)
+	}
+}
+
+// smtpMailer отправляет почтовые сообщения через сервер SMTP.
+type smtpMailer struct {
+	config *MailConfig
+}
+
+// Send отправляет сообщение через сервер SMTP.
+func (m *smtpMailer) Send(to string, message []byte) error {
+	// адрес получателя разбирается, чтобы не передать серверу в команде
+	// RCPT посторонние символы
+	rcpt, err := mail.ParseAddress(to)
+	if err != nil {
+		return err
+	}
+	var port = m.config.Port
+	if port == 0 {
+		switch m.config.Security {
+		case securityTLS:
+			port = 465
+		case securityNone:
+			port = 25
+		default:
+			port = 587
+		}
+	}
+	var addr = net.JoinHostPort(m.config.Host, strconv.Itoa(port))
+	var tlsConfig = &tls.Config{ServerName: m.config.Host}
+	var dialer = &net.Dialer{Timeout: time.Second * 30}
+	var conn net.Conn
+	if m.config.Security == securityTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	client, err := smtp.NewClient(conn, m.config.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if m.config.Security == "" || m.config.Security == securitySTARTTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return errors.New("smtp server does not support starttls")
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	switch m.config.Auth {
+	case "plain":
+		err = client.Auth(smtp.PlainAuth("", m.config.Username,
+			m.config.Password, m.config.Host))
+	case "login":
+		err = client.Auth(&loginAuth{m.config.Username, m.config.Password})
+	}
+	if err != nil {
+		return err
+	}
+	from, err := mail.ParseAddress(m.config.From)
+	if err != nil {
+		return err
+	}
+	if err := client.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := client.Rcpt(rcpt.Address); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(message); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// loginAuth реализует авторизацию SMTP AUTH LOGIN. Как и smtp.PlainAuth,
+// она не передает пароль по незащищенному соединению, кроме соединения с
+// локальным сервером.
+type loginAuth struct {
+	username, password string
+}
+
+// Start начинает авторизацию.
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && server.Name != "localhost" &&
+		server.Name != "127.0.0.1" && server.Name != "::1" {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	return "LOGIN", nil, nil
+}
+
+// Next отвечает на запросы сервера имени пользователя и пароля.
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected smtp login challenge %q", fromServer)
+	}
+}
+
+// fileMailer сохраняет почтовые сообщения в файлы вместо отправки. Такой
+// способ доставки предназначен для разработки и отладки.
+type fileMailer struct {
+	path    string // каталог для сохранения
+	maildir bool   // формат Maildir
+}
+
+// Send сохраняет сообщение в файл. В формате Maildir сообщение сначала
+// записывается в подкаталог tmp, а затем переносится в new.
+func (m *fileMailer) Send(to string, message []byte) error {
+	random, err := randomString(8)
+	if err != nil {
+		return err
+	}
+	var name = fmt.Sprintf("%d.%s", time.Now().UnixNano(), random)
+	if !m.maildir {
+		if err := os.MkdirAll(m.path, 0700); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(m.path, name+".eml"), message, 0600)
+	}
+	for _, dir := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(m.path, dir), 0700); err != nil {
+			return err
+		}
+	}
+	if host, err := os.Hostname(); err == nil {
+		name += "." + strings.NewReplacer("/", "\\057", ":", "\\072").Replace(host)
+	}
+	var tmp = filepath.Join(m.path, "tmp", name)
+	if err := ioutil.WriteFile(tmp, message, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(m.path, "new", name))
+}
+
+// GetMailConfig отдает настройки доставки почтовых сообщений. Пароль
+// сервера SMTP не отдается.
+func (s *Store) GetMailConfig(c *rest.Context) error {
+	var config = &MailConfig{Transport: transportGmail}
+	if err := s.load(sectionConfig, "mail", config); err != nil &&
+		err != rest.ErrNotFound {
+		return err
+	}
+	config.Password = ""
+	return c.Write(config)
+}
+
+// SetMailConfig задает настройки доставки почтовых сообщений. Если пароль
+// не указан, то сохраняется ранее заданный.
+func (s *Store) SetMailConfig(c *rest.Context) error {
+	var config = new(MailConfig)
+	if err := c.Bind(config); err != nil {
+		return c.Error(http.StatusBadRequest, err.Error())
+	}
+	if config.From != "" {
+		if _, err := mail.ParseAddress(config.From); err != nil {
+			return c.Error(http.StatusBadRequest, "bad from address")
+		}
+	}
+	switch config.Transport {
+	case "", transportGmail:
+		config.Transport = transportGmail
+	case transportSMTP:
+		if config.Host == "" {
+			return c.Error(http.StatusBadRequest, "smtp host required")
+		}
+		if config.From == "" {
+			return c.Error(http.StatusBadRequest, "from address required")
+		}
+		if config.Port < 0 || config.Port > 65535 {
+			return c.Error(http.StatusBadRequest, "bad smtp port")
+		}
+		switch config.Security {
+		case "", securitySTARTTLS, securityTLS, securityNone:
+		default:
+			return c.Error(http.StatusBadRequest, "bad smtp security")
+		}
+		switch config.Auth {
+		case "":
+		case "plain", "login":
+			if config.Username == "" {
+				return c.Error(http.StatusBadRequest, "smtp username required")
+			}
+		default:
+			return c.Error(http.StatusBadRequest, "bad smtp auth")
+		}
+	case transportFile, transportMaildir:
+		if config.Path == "" {
+			return c.Error(http.StatusBadRequest, "path required")
+		}
+	default:
+		return c.Error(http.StatusBadRequest, "bad mail transport")
+	}
+	if config.Password == "" {
+		var old = new(MailConfig)
+		if err := s.load(sectionConfig, "mail", old); err == nil {
+			config.Password = old.Password
+		}
+	}
+	return s.save(sectionConfig, "mail", config)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/base64"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// smtpSession содержит команды и данные, полученные тестовым сервером SMTP
+// за одно соединение.
+type smtpSession struct {
+	commands []string // полученные команды
+	auth     []string // расшифрованные данные авторизации
+	data     string   // текст сообщения
+}
+
+// testSMTP описывает тестовый сервер SMTP, который принимает одно
+// соединение.
+type testSMTP struct {
+	net.Listener
+	starttls bool              // поддержка STARTTLS
+	done     chan *smtpSession // данные завершенного соединения
+}
+
+func newTestSMTP(t *testing.T, starttls bool) *testSMTP {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var srv = &testSMTP{Listener: listener, starttls: starttls,
+		done: make(chan *smtpSession, 1)}
+	t.Cleanup(func() { srv.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var session = new(smtpSession)
+		srv.serve(textproto.NewConn(conn), session)
+		srv.done <- session
+	}()
+	return srv
+}
+
+// serve обрабатывает команды клиента до завершения соединения.
+func (srv *testSMTP) serve(conn *textproto.Conn, session *smtpSession) {
+	var decode = func(line string) string {
+		data, _ := base64.StdEncoding.DecodeString(line)
+		return string(data)
+	}
+	conn.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := conn.ReadLine()
+		if err != nil {
+			return
+		}
+		session.commands = append(session.commands, line)
+		var fields = strings.Fields(line)
+		switch strings.ToUpper(fields[0]) {
+		case "EHLO":
+			conn.PrintfLine("250-localhost")
+			if srv.starttls {
+				conn.PrintfLine("250-STARTTLS")
+			}
+			conn.PrintfLine("250 AUTH PLAIN LOGIN")
+		case "AUTH":
+			if len(fields) > 2 && fields[1] == "PLAIN" {
+				session.auth = append(session.auth, decode(fields[2]))
+			} else if fields[1] == "LOGIN" {
+				for _, prompt := range []string{"Username:", "Password:"} {
+					conn.PrintfLine("334 %s",
+						base64.StdEncoding.EncodeToString([]byte(prompt)))
+					line, err := conn.ReadLine()
+					if err != nil {
+						return
+					}
+					session.auth = append(session.auth, decode(line))
+				}
+			}
+			conn.PrintfLine("235 authenticated")
+		case "MAIL", "RCPT":
+			conn.PrintfLine("250 ok")
+		case "DATA":
+			conn.PrintfLine("354 go ahead")
+			data, err := conn.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			session.data = string(data)
+			conn.PrintfLine("250 ok")
+		case "QUIT":
+			conn.PrintfLine("221 bye")
+			return
+		default:
+			conn.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+// config возвращает настройки доставки почты через тестовый сервер.
+func (srv *testSMTP) config(security, auth string) *MailConfig {
+	return &MailConfig{
+		Transport: transportSMTP,
+		From:      "Service <noreply@test.com>",
+		// smtp.PlainAuth без TLS передает пароль только на localhost
+		Host:     "localhost",
+		Port:     srv.Addr().(*net.TCPAddr).Port,
+		Security: security,
+		Auth:     auth,
+		Username: "user",
+		Password: "secret",
+	}
+}
+
+func TestSMTPStartTLSRequired(t *testing.T) {
+	var srv = newTestSMTP(t, false)
+	var mailer = &smtpMailer{config: srv.config("", "plain")}
+	if err := mailer.Send("user@test.com", []byte("test")); err == nil ||
+		!strings.Contains(err.Error(), "starttls") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	var session = <-srv.done
+	for _, command := range session.commands {
+		if !strings.HasPrefix(command, "EHLO") {
+			t.Errorf("unexpected command %q", command)
+		}
+	}
+}
+
+func TestSMTPSend(t *testing.T) {
+	for _, test := range []struct {
+		auth string
+		want []string
+	}{
+		{"plain", []string{"\x00user\x00secret"}},
+		{"login", []string{"user", "secret"}},
+		{"", nil},
+	} {
+		var srv = newTestSMTP(t, false)
+		var mailer = &smtpMailer{config: srv.config(securityNone, test.auth)}
+		if err := mailer.Send("User <user@test.com>", []byte("Subject: test\r\n\r\nbody\r\n")); err != nil {
+			t.Fatalf("%s: %v", test.auth, err)
+		}
+		var session = <-srv.done
+		if strings.Join(session.auth, "|") != strings.Join(test.want, "|") {
+			t.Errorf("%s: auth %q", test.auth, session.auth)
+		}
+		var commands = strings.Join(session.commands, "\n")
+		if !strings.Contains(commands, "MAIL FROM:<noreply@test.com>") ||
+			!strings.Contains(commands, "RCPT TO:<user@test.com>") {
+			t.Errorf("%s: commands %q", test.auth, session.commands)
+		}
+		if session.data != "Subject: test\n\nbody\n" {
+			t.Errorf("%s: data %q", test.auth, session.data)
+		}
+	}
+}
+
+func TestSMTPBadRecipient(t *testing.T) {
+	var srv = newTestSMTP(t, false)
+	var mailer = &smtpMailer{config: srv.config(securityNone, "")}
+	if err := mailer.Send("user@test.com>\r\nRCPT TO:<other@test.com", nil); err == nil {
+		t.Fatal("bad recipient accepted")
+	}
+}
+
+func TestMessageHeaderInjection(t *testing.T) {
+	var store = testStore(t)
+	if err := store.save(sectionTemplates, "test", &MailTemplate{
+		Subject:  "Test",
+		Template: "Hello",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	template, err := store.Template("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := template.Message("", "user@test.com\r\nBcc: other@test.com", nil); err == nil {
+		t.Fatal("header injection accepted")
+	}
+	message, err := template.Message("Service <noreply@test.com>", "User <user@test.com>", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, header := range []string{
+		"From: \"Service\" <noreply@test.com>\r\n",
+		"To: \"User\" <user@test.com>\r\n",
+	} {
+		if !strings.Contains(string(message), header) {
+			t.Errorf("header %q not found in %q", header, message)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
 	"net/http"
 	"os"
@@ -30,6 +31,25 @@ func main() {
 		"http server `port`")
 	var letsencrypt = flag.String("letsencrypt", app.Env("LETSENCRYPT_HOST", ""),
 		"domain `host` name")
+	var archive = flag.Bool("archive", app.Env("ARCHIVE", "") != "",
+		"archive deleted users data")
+	var sweep = flag.Bool("sweep", false,
+		"remove orphaned users data and exit")
+	flag.BoolVar(&StrictPasswords, "strict", app.Env("STRICT", "") != "",
+		"refuse to compare plaintext stored passwords")
+	var hash = flag.String("hash", app.Env("HASH", "bcrypt"),
+		"password hash `algorithm` and parameters")
+	var azureAudience = flag.String("azure-audience", app.Env("AZURE_AUDIENCE", ""),
+		"comma separated accepted azure token `audiences`")
+	flag.DurationVar(&ClockSkew, "skew", ClockSkew, "token clock skew `duration`")
+	flag.DurationVar(&ValidTokenPeriod, "reset-period", ValidTokenPeriod,
+		"password reset token lifetime `duration`")
+	flag.StringVar(&PublicURL, "url", app.Env("URL", ""),
+		"public user server `url` for links")
+	var clientCerts = flag.Bool("client-certs", app.Env("CLIENT_CERTS", "") != "",
+		"request user tls client certificates")
+	flag.StringVar(&ClientCRL, "crl", app.Env("CRL", ""),
+		"client certificates revocation list `filename`")
 	var dbname = appName + ".db" // имя файла с хранилищем
 	if app.IsDocker() {
 		dbname = path.Join("db", dbname)
@@ -41,6 +61,21 @@ func main() {
 	app.Parse(appName, version, commit, date)
 	log.Info("service", app.LogInfo())
 
+	hasher, err := ParseHasher(*hash)
+	if err != nil {
+		log.Error("password hash parse error", "error", err)
+		os.Exit(2)
+	}
+	DefaultHasher = hasher
+	// по умолчанию внешний адрес определяется по имени домена Let's Encrypt
+	if PublicURL == "" && *letsencrypt != "" {
+		PublicURL = "https://" + strings.Split(*letsencrypt, ",")[0]
+	}
+	if *azureAudience != "" {
+		AzureAudiences = strings.Split(*azureAudience, ",")
+		setProviders(nil)
+	}
+
 	// разбираем имя хоста и порт, на котором будет слушать веб-сервер
 	port, err := app.Port(*httphost)
 	if err != nil {
@@ -60,6 +95,80 @@ func main() {
 		os.Exit(1)
 	}
 	defer store.Close()
+	store.Archive = *archive
+	// заменяем сохраненные в открытом виде пароли на хеши
+	plaintext, err := store.Plaintext(true)
+	if err != nil {
+		log.Error("hashing plaintext passwords error", "error", err)
+		os.Exit(1)
+	}
+	for section, names := range plaintext {
+		log.Warn("plaintext passwords hashed", "section", section, "names", names)
+	}
+	if err := store.LoadLockoutPolicy(); err != nil {
+		log.Error("loading lockout policy error", "error", err)
+		os.Exit(1)
+	}
+	if err := store.LoadPasswordPolicy(); err != nil {
+		log.Error("loading password policy error", "error", err)
+		os.Exit(1)
+	}
+	if err := store.LoadResetPolicy(); err != nil {
+		log.Error("loading reset policy error", "error", err)
+		os.Exit(1)
+	}
+	if err := store.LoadRoles(); err != nil {
+		log.Error("loading admin roles error", "error", err)
+		os.Exit(1)
+	}
+	if err := store.LoadProviders(); err != nil {
+		log.Error("loading token providers error", "error", err)
+		os.Exit(1)
+	}
+	// до появления проверки aud токены принимались без нее: предупреждаем,
+	// что теперь токены таких провайдеров отклоняются
+	if names := unconfiguredProviders(); len(names) > 0 {
+		log.Warn("token providers without audiences reject all tokens",
+			"providers", names)
+	}
+	if err := store.LoadJWKS(); err != nil {
+		log.Error("loading jwks error", "error", err)
+		os.Exit(1)
+	}
+	if err := store.LoadCA(); err != nil {
+		log.Error("loading certificate authority error", "error", err)
+		os.Exit(1)
+	}
+	if err := store.LoadClientCAs(); err != nil {
+		log.Error("loading client certificate authorities error", "error", err)
+		os.Exit(1)
+	}
+	if err := store.LoadSessionKey(); err != nil {
+		log.Error("loading session key error", "error", err)
+		os.Exit(1)
+	}
+	if err := store.PurgeRefreshTokens(); err != nil {
+		log.Error("purging refresh tokens error", "error", err)
+		os.Exit(1)
+	}
+	if err := store.PurgeResetTokens(); err != nil {
+		log.Error("purging password reset tokens error", "error", err)
+		os.Exit(1)
+	}
+
+	// удаляем данные, не привязанные ни к одному пользователю, и завершаем
+	// работу сервиса
+	if *sweep {
+		orphans, err := store.Orphans(true)
+		if err != nil {
+			log.Error("sweep error", "error", err)
+			os.Exit(1)
+		}
+		for section, keys := range orphans {
+			log.Info("orphaned data removed", "section", section, "keys", keys)
+		}
+		return
+	}
 
 	var adminMux = &rest.ServeMux{
 		Headers: map[string]string{
@@ -86,13 +195,46 @@ func main() {
 			"PUT":    store.Update(sectionGroups),
 			"DELETE": store.Remove(sectionGroups),
 		},
+		"/platforms": rest.Methods{
+			"GET": store.List(sectionPlatforms),
+		},
+		"/platforms/:name": rest.Methods{
+			"GET":    store.Item(sectionPlatforms),
+			"PUT":    store.Update(sectionPlatforms),
+			"DELETE": store.Remove(sectionPlatforms),
+		},
 		"/users": rest.Methods{
 			"GET": store.List(sectionUsers),
 		},
 		"/users/:name": rest.Methods{
 			"GET":    store.Item(sectionUsers),
 			"PUT":    store.Update(sectionUsers),
-			"DELETE": store.Remove(sectionUsers),
+			"DELETE": store.RemoveUser,
+		},
+		"/disable": rest.Methods{
+			"POST": store.SetUsersStatus(true),
+		},
+		"/enable": rest.Methods{
+			"POST": store.SetUsersStatus(false),
+		},
+		"/users/:name/rename": rest.Methods{
+			"POST": store.RenameUser,
+		},
+		"/users/:name/enroll": rest.Methods{
+			"POST": store.CreateEnrollment,
+		},
+		"/users/:name/devices": rest.Methods{
+			"GET": store.Devices,
+		},
+		"/users/:name/devices/:id": rest.Methods{
+			"PUT":    store.UpdateDevice,
+			"DELETE": store.RemoveDevice,
+		},
+		"/users/:name/certs": rest.Methods{
+			"GET": store.Certificates,
+		},
+		"/users/:name/certs/:serial": rest.Methods{
+			"DELETE": store.RevokeCertificate,
 		},
 		"/users/:name/config": rest.Methods{
 			"GET": store.UserConfig,
@@ -107,14 +249,62 @@ func main() {
 			"GET": store.List(sectionAdmins),
 		},
 		"/admins/:name": rest.Methods{
-			"GET":    store.Item(sectionAdmins),
+			"GET":    store.AdminItem,
 			"PUT":    store.Update(sectionAdmins),
-			"DELETE": store.Remove(sectionAdmins),
+			"DELETE": store.RemoveAdmin,
+		},
+		"/admins/:name/keys": rest.Methods{
+			"GET":  store.APIKeys,
+			"POST": store.CreateAPIKey,
+		},
+		"/admins/:name/keys/:id": rest.Methods{
+			"DELETE": store.RemoveAPIKey,
+		},
+		"/admins/:name/totp": rest.Methods{
+			"POST":   store.EnrollTOTP,
+			"PUT":    store.ConfirmTOTP,
+			"DELETE": store.RemoveTOTP,
+		},
+		"/roles": rest.Methods{
+			"GET": store.GetRoles,
+			"PUT": store.SetRoles,
+		},
+		"/providers": rest.Methods{
+			"GET": store.GetProviders,
+			"PUT": store.SetProviders,
+		},
+		"/ca": rest.Methods{
+			"GET":  store.GetCA,
+			"POST": store.CreateCA,
+		},
+		"/cas": rest.Methods{
+			"GET": store.ClientCAs,
+		},
+		"/cas/:name": rest.Methods{
+			"PUT":    store.SetClientCA,
+			"DELETE": store.RemoveClientCA,
+		},
+		"/jwks": rest.Methods{
+			"GET": store.JWKS,
+		},
+		"/oidc": rest.Methods{
+			"GET": store.GetOIDCConfig,
+			"PUT": store.SetOIDCConfig,
+		},
+		"/login": rest.Methods{
+			"POST": store.Login,
+		},
+		"/logout": rest.Methods{
+			"POST": store.Logout,
 		},
 		"/gmail": rest.Methods{
 			"GET": store.GetGmailConfig,
 			"PUT": store.SetGmailConfig,
 		},
+		"/mail": rest.Methods{
+			"GET": store.GetMailConfig,
+			"PUT": store.SetMailConfig,
+		},
 		"/templates": rest.Methods{
 			"GET": store.List(sectionTemplates),
 		},
@@ -126,10 +316,66 @@ func main() {
 		"/templates/:name/send/:to": rest.Methods{
 			"POST": store.SendWithTemplate,
 		},
+		"/pages": rest.Methods{
+			"GET": store.WebPages,
+		},
+		"/pages/:name": rest.Methods{
+			"GET":    store.WebPage,
+			"PUT":    store.SetWebPage,
+			"DELETE": store.Remove(sectionPages),
+		},
+		"/sweep": rest.Methods{
+			"GET":    store.Sweep,
+			"DELETE": store.Sweep,
+		},
+		"/policy/lockout": rest.Methods{
+			"GET": store.GetLockoutPolicy,
+			"PUT": store.SetLockoutPolicy,
+		},
+		"/policy/password": rest.Methods{
+			"GET":  store.GetPasswordPolicy,
+			"PUT":  store.SetPasswordPolicy,
+			"POST": store.CheckPasswordPolicy,
+		},
+		"/policy/selfservice": rest.Methods{
+			"GET": store.GetSelfService,
+			"PUT": store.SetSelfService,
+		},
+		"/policy/reset": rest.Methods{
+			"GET": store.GetResetPolicy,
+			"PUT": store.SetResetPolicy,
+		},
+		"/plaintext": rest.Methods{
+			"GET":  store.PlaintextReport,
+			"POST": store.PlaintextReport,
+		},
+		"/lockouts": rest.Methods{
+			"GET": store.Lockouts,
+		},
+		"/lockouts/:name": rest.Methods{
+			"DELETE": store.ClearLockout,
+		},
 		"/backup": rest.Methods{
 			"GET": store.Backup,
 		},
 	}, store.AdminAuth) // все запросы требуют авторизации администратора
+	// авторизация администраторов через OpenID Connect
+	adminMux.Handle("GET", "/oidc/login", store.OIDCLogin)
+	adminMux.Handle("GET", "/oidc/callback", store.OIDCCallback)
+
+	// обновляем в фоне списки ключей провайдеров токенов
+	go RefreshJWKS(time.Minute)
+	// периодически удаляем токены, время действия которых истекло
+	go func() {
+		for range time.Tick(time.Hour) {
+			if err := store.PurgeResetTokens(); err != nil {
+				log.Warn("purging password reset tokens error", "error", err)
+			}
+			if err := store.PurgeRefreshTokens(); err != nil {
+				log.Warn("purging refresh tokens error", "error", err)
+			}
+		}
+	}()
 
 	// инициализируем HTTP-сервер для административной части сервиса
 	aserver := &http.Server{
@@ -160,10 +406,30 @@ func main() {
 		Logger: httplogger,
 	}
 	mux.Handle("GET", "/config", store.Config)
+	mux.Handle("POST", "/login", store.UserLogin)
+	mux.Handle("POST", "/refresh", store.UserRefresh)
+	mux.Handle("POST", "/enroll/:code", store.Enroll)
+	mux.Handle("POST", "/certificate", store.IssueCertificate)
+	mux.Handle("GET", "/crl", store.CRL)
+	mux.Handle("GET", "/reset", store.ResetChallenge)
 	mux.Handle("POST", "/reset/:name", store.PasswordToken)
 	mux.Handle("POST", "/password", store.SetUserPassword)
+	mux.Handle("GET", "/password/:token", store.CheckResetToken)
 	mux.Handle("POST", "/password/:token", store.ResetPassword)
 	mux.Handle("GET", "/data", store.UserData)
+	mux.Handle("PUT", "/data", store.UserDataUpdate)
+	mux.Handle("PATCH", "/data", store.UserDataUpdate)
+	mux.Handle("PATCH", "/profile", store.UserProfilePatch)
+	mux.Handle("GET", "/policy", store.PublicPasswordPolicy)
+	mux.Handle("POST", "/policy", store.CheckPasswordPolicy)
+	// страницы для сброса и смены пароля пользователем
+	mux.Handle("GET", "/web/reset", store.WebReset)
+	mux.Handle("POST", "/web/reset", store.WebResetSubmit)
+	mux.Handle("GET", "/web/password/:token", store.WebPassword)
+	mux.Handle("POST", "/web/password/:token", store.WebPasswordSubmit)
+	mux.Handle("GET", "/web/pow.js", store.WebScript)
+	mux.Handle("GET", "/web/change", store.WebChange)
+	mux.Handle("POST", "/web/change", store.WebChangeSubmit)
 
 	var server = &http.Server{
 		Addr:         port,
@@ -193,6 +459,16 @@ func main() {
 		}
 	}
 
+	// запрашиваем клиентские сертификаты; они проверяются при авторизации
+	// пользователя, чтобы список доверенных центров можно было изменять
+	if *clientCerts {
+		if server.TLSConfig == nil {
+			httplogger.Warn("client certificates require tls")
+		} else {
+			server.TLSConfig.ClientAuth = tls.RequestClientCert
+		}
+	}
+
 	// отслеживаем сигнал о прерывании и останавливаем по нему сервер
 	go func() {
 		var sigint = make(chan os.Signal, 1)
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdigger/log"
+	"github.com/mdigger/rest"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ClientCRL задает имя локального файла со списками отозванных клиентских
+// сертификатов в формате PEM или DER. Каждый список должен быть подписан
+// одним из доверенных удостоверяющих центров. Файл загружается повторно при
+// его изменении.
+var ClientCRL string
+
+// ClientCA описывает именованный список сертификатов доверенных
+// удостоверяющих центров. Подписанные ими клиентские сертификаты принимаются
+// только для пользователей из указанных групп или Azure AD.
+type ClientCA struct {
+	Certificates string   `json:"certificates"`      // сертификаты в формате PEM
+	Groups       []string `json:"groups,omitempty"`  // группы пользователей
+	Tenants      []string `json:"tenants,omitempty"` // идентификаторы Azure AD
+	certs        []*x509.Certificate
+	pool         *x509.CertPool
+}
+
+// decodeClientCA разбирает сохраненный список сертификатов. Для
+// совместимости поддерживается старый формат, в котором сохранялись только
+// сертификаты без привязки к пользователям.
+func decodeClientCA(data []byte) (*ClientCA, error) {
+	var ca = new(ClientCA)
+	if len(data) > 1 && data[0] == '{' {
+		if err := json.Unmarshal(data, ca); err != nil {
+			return nil, err
+		}
+	} else {
+		ca.Certificates = string(data)
+	}
+	certs, err := parseCertificates([]byte(ca.Certificates))
+	if err != nil {
+		return nil, err
+	}
+	ca.certs = certs
+	ca.pool = x509.NewCertPool()
+	for _, cert := range certs {
+		ca.pool.AddCert(cert)
+	}
+	return ca, nil
+}
+
+// Allowed возвращает true, если пользователь относится к группам или Azure
+// AD, для которых задан список сертификатов. Сертификаты без привязки не
+// принимаются ни для каких пользователей.
+func (ca *ClientCA) Allowed(user *User) bool {
+	for _, group := range ca.Groups {
+		if user.Group == group {
+			return true
+		}
+	}
+	for _, tenant := range ca.Tenants {
+		if user.Tenant != "" && user.Tenant == tenant {
+			return true
+		}
+	}
+	return false
+}
+
+// clientCAs содержит сертификат встроенного удостоверяющего центра и
+// именованные списки доверенных сертификатов удостоверяющих центров, которыми
+// должны быть подписаны клиентские сертификаты пользователей.
+var clientCAs = struct {
+	builtin *x509.Certificate
+	list    map[string]*ClientCA
+	mu      sync.RWMutex
+}{}
+
+// clientCRL содержит серийные номера отозванных клиентских сертификатов для
+// каждого издателя, загруженные из файла ClientCRL.
+var clientCRL = struct {
+	serials  map[string]map[string]bool // издатель и серийные номера
+	modified time.Time                  // время изменения загруженного файла
+	mu       sync.Mutex
+}{}
+
+// parseCertificates разбирает список сертификатов в формате PEM.
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+	return certs, nil
+}
+
+// LoadClientCAs загружает из хранилища доверенные сертификаты удостоверяющих
+// центров для проверки клиентских сертификатов. К ним добавляется сертификат
+// встроенного удостоверяющего центра, если он создан.
+func (s *Store) LoadClientCAs() error {
+	var list = make(map[string]*ClientCA)
+	var unbound []string // списки без привязки к пользователям
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		var bucket = tx.Bucket([]byte(sectionCAs))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			ca, err := decodeClientCA(v)
+			if err != nil {
+				return err
+			}
+			if len(ca.Groups) == 0 && len(ca.Tenants) == 0 {
+				unbound = append(unbound, string(k))
+			}
+			list[string(k)] = ca
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+	if len(unbound) > 0 {
+		log.Warn("client certificate authorities without groups or tenants are ignored",
+			"cas", unbound)
+	}
+	authority.mu.RLock()
+	var builtin = authority.cert
+	authority.mu.RUnlock()
+	clientCAs.mu.Lock()
+	clientCAs.builtin = builtin
+	clientCAs.list = list
+	clientCAs.mu.Unlock()
+	return nil
+}
+
+// crlIssuer возвращает доверенный сертификат удостоверяющего центра, которым
+// подписан список отозванных сертификатов.
+func crlIssuer(crl *x509.RevocationList) (*x509.Certificate, error) {
+	clientCAs.mu.RLock()
+	defer clientCAs.mu.RUnlock()
+	var certs []*x509.Certificate
+	if clientCAs.builtin != nil {
+		certs = append(certs, clientCAs.builtin)
+	}
+	for _, ca := range clientCAs.list {
+		certs = append(certs, ca.certs...)
+	}
+	for _, cert := range certs {
+		if bytes.Equal(cert.RawSubject, crl.RawIssuer) &&
+			crl.CheckSignatureFrom(cert) == nil {
+			return cert, nil
+		}
+	}
+	return nil, fmt.Errorf("crl issuer %s is not trusted", crl.Issuer)
+}
+
+// parseCRLs разбирает списки отозванных сертификатов в формате PEM или DER и
+// проверяет их подписи. Возвращает серийные номера отозванных сертификатов
+// для каждого издателя.
+func parseCRLs(data []byte) (map[string]map[string]bool, error) {
+	var list [][]byte
+	for remain := data; ; {
+		var block *pem.Block
+		block, remain = pem.Decode(remain)
+		if block == nil {
+			break
+		}
+		if block.Type == "X509 CRL" {
+			list = append(list, block.Bytes)
+		}
+	}
+	if len(list) == 0 {
+		list = append(list, data) // формат DER
+	}
+	var result = make(map[string]map[string]bool, len(list))
+	for _, der := range list {
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return nil, err
+		}
+		issuer, err := crlIssuer(crl)
+		if err != nil {
+			return nil, err
+		}
+		var serials = result[string(issuer.RawSubject)]
+		if serials == nil {
+			serials = make(map[string]bool, len(crl.RevokedCertificateEntries))
+			result[string(issuer.RawSubject)] = serials
+		}
+		for _, revoked := range crl.RevokedCertificateEntries {
+			serials[revoked.SerialNumber.String()] = true
+		}
+	}
+	return result, nil
+}
+
+// certRevoked возвращает true, если сертификат отозван издавшим его
+// удостоверяющим центром. Списки отозванных сертификатов загружаются из
+// файла ClientCRL при его изменении.
+func certRevoked(cert *x509.Certificate) (bool, error) {
+	if ClientCRL == "" {
+		return false, nil
+	}
+	info, err := os.Stat(ClientCRL)
+	if err != nil {
+		return false, err
+	}
+	clientCRL.mu.Lock()
+	defer clientCRL.mu.Unlock()
+	if !info.ModTime().Equal(clientCRL.modified) {
+		data, err := ioutil.ReadFile(ClientCRL)
+		if err != nil {
+			return false, err
+		}
+		serials, err := parseCRLs(data)
+		if err != nil {
+			return false, err
+		}
+		clientCRL.serials = serials
+		clientCRL.modified = info.ModTime()
+	}
+	return clientCRL.serials[string(cert.RawIssuer)][cert.SerialNumber.String()], nil
+}
+
+// certUser проверяет клиентский сертификат и возвращает пользователя, для
+// которого он выпущен. Пользователь определяется по email из альтернативных
+// имен сертификата или, если он не задан, по имени субъекта. Сертификат,
+// подписанный одним из доверенных центров, принимается только для
+// пользователей, к группам или Azure AD которых этот центр привязан.
+func (s *Store) certUser(c *rest.Context) (*User, error) {
+	var certs = c.Request.TLS.PeerCertificates
+	var intermediates = x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	var verify = func(pool *x509.CertPool) bool {
+		_, err := certs[0].Verify(x509.VerifyOptions{
+			Roots:         pool,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		return err == nil
+	}
+	// определяем удостоверяющие центры, которыми подписан сертификат
+	var builtin bool
+	var issuers []*ClientCA
+	clientCAs.mu.RLock()
+	if clientCAs.builtin != nil {
+		var pool = x509.NewCertPool()
+		pool.AddCert(clientCAs.builtin)
+		builtin = verify(pool)
+	}
+	for _, ca := range clientCAs.list {
+		if verify(ca.pool) {
+			issuers = append(issuers, ca)
+		}
+	}
+	clientCAs.mu.RUnlock()
+	if !builtin && len(issuers) == 0 {
+		return nil, rest.NewError(http.StatusForbidden, "client certificate not trusted")
+	}
+	revoked, err := certRevoked(certs[0])
+	if err != nil {
+		return nil, err
+	}
+	if revoked || issuedRevoked(certs[0]) {
+		return nil, rest.NewError(http.StatusForbidden, "client certificate revoked")
+	}
+	var id string
+	if len(certs[0].EmailAddresses) > 0 {
+		id = certs[0].EmailAddresses[0]
+	} else if name := certs[0].Subject.CommonName; strings.ContainsRune(name, '@') {
+		id = name
+	} else {
+		return nil, rest.NewError(http.StatusForbidden, "client certificate user required")
+	}
+	c.AddLogField("user", id) // добавляем в лог имя пользователя
+	user, err := s.User(id)
+	if err == rest.ErrNotFound {
+		return nil, rest.ErrForbidden
+	}
+	if err != nil {
+		return nil, err
+	}
+	// сертификаты встроенного центра выпускаются только самим пользователям
+	var allowed = builtin
+	for _, ca := range issuers {
+		allowed = allowed || ca.Allowed(user)
+	}
+	if !allowed {
+		return nil, rest.NewError(http.StatusForbidden,
+			"client certificate authority not allowed for user")
+	}
+	if err := user.Check(); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// CAInfo описывает сертификат удостоверяющего центра.
+type CAInfo struct {
+	Subject string    `json:"subject"`
+	Serial  string    `json:"serial"`
+	Expires time.Time `json:"expires"`
+}
+
+// ClientCAs отдает список доверенных удостоверяющих центров с описанием их
+// сертификатов и пользователей, для которых они принимаются.
+func (s *Store) ClientCAs(c *rest.Context) error {
+	var list = make(map[string]rest.JSON)
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		var bucket = tx.Bucket([]byte(sectionCAs))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			ca, err := decodeClientCA(v)
+			if err != nil {
+				return err
+			}
+			var info = make([]CAInfo, len(ca.certs))
+			for i, cert := range ca.certs {
+				info[i] = CAInfo{
+					Subject: cert.Subject.String(),
+					Serial:  cert.SerialNumber.String(),
+					Expires: cert.NotAfter.UTC(),
+				}
+			}
+			list[string(k)] = rest.JSON{
+				"certificates": info,
+				"groups":       ca.Groups,
+				"tenants":      ca.Tenants,
+			}
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+	return c.Write(rest.JSON{sectionCAs: list})
+}
+
+// SetClientCA сохраняет именованный список сертификатов доверенных
+// удостоверяющих центров. Сертификаты передаются в теле запроса в формате
+// PEM, а группы и Azure AD пользователей, для которых они принимаются, — в
+// параметрах запроса group и tenant.
+func (s *Store) SetClientCA(c *rest.Context) error {
+	data, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		return c.Error(http.StatusBadRequest, err.Error())
+	}
+	var query = c.Request.URL.Query()
+	var ca = &ClientCA{
+		Certificates: string(data),
+		Groups:       query["group"],
+		Tenants:      query["tenant"],
+	}
+	if len(ca.Groups) == 0 && len(ca.Tenants) == 0 {
+		return c.Error(http.StatusBadRequest, "group or tenant required")
+	}
+	if _, err := parseCertificates(data); err != nil {
+		return c.Error(http.StatusBadRequest, err.Error())
+	}
+	if err := s.save(sectionCAs, c.Param("name"), ca); err != nil {
+		return err
+	}
+	return s.LoadClientCAs()
+}
+
+// RemoveClientCA удаляет именованный список сертификатов доверенных
+// удостоверяющих центров.
+func (s *Store) RemoveClientCA(c *rest.Context) error {
+	if err := s.Remove(sectionCAs)(c); err != nil {
+		return err
+	}
+	return s.LoadClientCAs()
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA описывает тестовый удостоверяющий центр.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var template = &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key,
+		pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue выпускает клиентский сертификат с указанным серийным номером.
+func (ca *testCA) issue(t *testing.T, serial int64, email string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber:   big.NewInt(serial),
+		Subject:        pkix.Name{CommonName: email},
+		EmailAddresses: []string{email},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// crl возвращает подписанный список отозванных сертификатов в формате PEM.
+func (ca *testCA) crl(t *testing.T, serials ...int64) []byte {
+	t.Helper()
+	var revoked = make([]x509.RevocationListEntry, len(serials))
+	for i, serial := range serials {
+		revoked[i] = x509.RevocationListEntry{
+			SerialNumber:   big.NewInt(serial),
+			RevocationTime: time.Now(),
+		}
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(1),
+		ThisUpdate:                time.Now(),
+		NextUpdate:                time.Now().Add(time.Hour),
+		RevokedCertificateEntries: revoked,
+	}, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+}
+
+func TestClientCABinding(t *testing.T) {
+	var ca = newTestCA(t, "Test CA")
+	// старый формат без привязки не принимается ни для каких пользователей
+	legacy, err := decodeClientCA(ca.pem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(legacy.certs) != 1 || legacy.Allowed(&User{Group: "staff"}) {
+		t.Fatal("legacy bundle allowed")
+	}
+	var store = testStore(t)
+	if err := store.save(sectionCAs, "partner", &ClientCA{
+		Certificates: string(ca.pem),
+		Groups:       []string{"partner"},
+		Tenants:      []string{"tenant"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		clientCAs.mu.Lock()
+		clientCAs.list, clientCAs.builtin = nil, nil
+		clientCAs.mu.Unlock()
+	}()
+	if err := store.LoadClientCAs(); err != nil {
+		t.Fatal(err)
+	}
+	var bound = clientCAs.list["partner"]
+	if bound == nil {
+		t.Fatal("bundle not loaded")
+	}
+	for _, test := range []struct {
+		user    *User
+		allowed bool
+	}{
+		{&User{Group: "partner"}, true},
+		{&User{Group: "staff", Tenant: "tenant"}, true},
+		{&User{Group: "staff"}, false},
+		{&User{Group: "staff", Tenant: "other"}, false},
+	} {
+		if bound.Allowed(test.user) != test.allowed {
+			t.Errorf("%+v: allowed %v", test.user, !test.allowed)
+		}
+	}
+}
+
+func TestClientCRL(t *testing.T) {
+	var first, second = newTestCA(t, "First CA"), newTestCA(t, "Second CA")
+	var untrusted = newTestCA(t, "Untrusted CA")
+	clientCAs.mu.Lock()
+	clientCAs.list = make(map[string]*ClientCA)
+	for name, ca := range map[string]*testCA{"first": first, "second": second} {
+		bundle, err := decodeClientCA(ca.pem)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientCAs.list[name] = bundle
+	}
+	clientCAs.mu.Unlock()
+	defer func() {
+		clientCAs.mu.Lock()
+		clientCAs.list = nil
+		clientCAs.mu.Unlock()
+		ClientCRL = ""
+		clientCRL.mu.Lock()
+		clientCRL.serials, clientCRL.modified = nil, time.Time{}
+		clientCRL.mu.Unlock()
+	}()
+
+	if _, err := parseCRLs(untrusted.crl(t, 2)); err == nil {
+		t.Fatal("crl of untrusted issuer accepted")
+	}
+	// список, подписанный другим ключом от имени доверенного центра
+	var forged = &testCA{cert: first.cert, key: untrusted.key}
+	if _, err := parseCRLs(forged.crl(t, 2)); err == nil {
+		t.Fatal("forged crl accepted")
+	}
+
+	ClientCRL = filepath.Join(t.TempDir(), "crl.pem")
+	if err := os.WriteFile(ClientCRL, first.crl(t, 2), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// серийные номера учитываются только для издавшего их центра
+	for _, test := range []struct {
+		cert    *x509.Certificate
+		revoked bool
+	}{
+		{first.issue(t, 2, "user@test.com"), true},
+		{first.issue(t, 3, "user@test.com"), false},
+		{second.issue(t, 2, "user@test.com"), false},
+	} {
+		revoked, err := certRevoked(test.cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if revoked != test.revoked {
+			t.Errorf("%s serial %s: revoked %v", test.cert.Issuer.CommonName,
+				test.cert.SerialNumber, revoked)
+		}
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	app "github.com/mdigger/app-info"
+	"github.com/mdigger/jwt"
+	"github.com/mdigger/rest"
+	"golang.org/x/oauth2"
+)
+
+// Discovery описывает конфигурацию провайдера OpenID Connect, получаемую
+// с помощью `/.well-known/openid-configuration`.
+type Discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// GetDiscovery запрашивает и разбирает конфигурацию провайдера OpenID
+// Connect.
+func GetDiscovery(issuer string) (*Discovery, error) {
+	var url = strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", app.Agent)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, rest.ErrServiceUnavailable // сервер провайдера ответил ошибкой
+	}
+	var discovery = new(Discovery)
+	if err := json.NewDecoder(resp.Body).Decode(discovery); err != nil {
+		return nil, err
+	}
+	if discovery.Issuer != strings.TrimSuffix(issuer, "/") &&
+		discovery.Issuer != issuer {
+		return nil, fmt.Errorf("oidc issuer mismatch: %s", discovery.Issuer)
+	}
+	return discovery, nil
+}
+
+// DiscoveryTTL задает время кеширования конфигурации провайдера OpenID
+// Connect.
+var DiscoveryTTL = time.Hour
+
+// oidcProvider описывает кешированную конфигурацию провайдера OpenID Connect
+// вместе с его ключами для проверки токенов.
+type oidcProvider struct {
+	*Discovery
+	auth    *Auth     // ключи для проверки токенов
+	expires time.Time // время окончания кеширования
+}
+
+// oidcProviders содержит кешированные конфигурации провайдеров OpenID
+// Connect.
+var oidcProviders = struct {
+	list map[string]*oidcProvider
+	mu   sync.Mutex
+}{list: make(map[string]*oidcProvider)}
+
+// getOIDCProvider возвращает конфигурацию провайдера OpenID Connect. Она
+// запрашивается повторно только по истечении DiscoveryTTL; при ошибке
+// запроса продолжает использоваться ранее полученная конфигурация.
+func getOIDCProvider(issuer string) (*oidcProvider, error) {
+	oidcProviders.mu.Lock()
+	var cached = oidcProviders.list[issuer]
+	oidcProviders.mu.Unlock()
+	if cached != nil && time.Now().Before(cached.expires) {
+		return cached, nil
+	}
+	discovery, err := GetDiscovery(issuer)
+	if err != nil {
+		if cached != nil {
+			return cached, nil
+		}
+		return nil, err
+	}
+	var provider = &oidcProvider{
+		Discovery: discovery,
+		auth:      NewAuth(discovery.JWKSURI),
+		expires:   time.Now().Add(DiscoveryTTL),
+	}
+	oidcProviders.mu.Lock()
+	oidcProviders.list[issuer] = provider
+	oidcProviders.mu.Unlock()
+	return provider, nil
+}
+
+// Audience описывает значение `aud` токена, которое может быть как строкой,
+// так и массивом строк.
+type Audience []string
+
+// UnmarshalJSON разбирает значение `aud` токена.
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var aud string
+		if err := json.Unmarshal(data, &aud); err != nil {
+			return err
+		}
+		*a = Audience{aud}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+// Contains возвращает true, если список содержит указанное значение.
+func (a Audience) Contains(aud string) bool {
+	for _, value := range a {
+		if value == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// OIDCConfig описывает настройки авторизации администраторов с помощью
+// OpenID Connect.
+type OIDCConfig struct {
+	Issuer      string              `json:"issuer"`              // адрес провайдера
+	ID          string              `json:"id"`                  // идентификатор клиента
+	Secret      string              `json:"secret"`              // секретный ключ клиента
+	RedirectURL string              `json:"redirect"`            // адрес /oidc/callback
+	NameClaim   string              `json:"nameClaim,omitempty"` // имя администратора
+	GroupsClaim string              `json:"groupsClaim,omitempty"`
+	Roles       map[string][]string `json:"roles"` // роли для групп
+}
+
+// oidcState хранит параметры начатых авторизаций OpenID Connect.
+var oidcState = struct {
+	list map[string]oidcRequest
+	mu   sync.Mutex
+}{list: make(map[string]oidcRequest)}
+
+// oidcStateCookie задает имя cookie, которое связывает начатую авторизацию
+// OpenID Connect с браузером администратора.
+const oidcStateCookie = "oidc_state"
+
+// oidcStateTTL задает время, отведенное администратору на авторизацию у
+// провайдера OpenID Connect.
+const oidcStateTTL = time.Minute * 10
+
+// oidcRequest описывает параметры начатой авторизации.
+type oidcRequest struct {
+	Nonce   string    // одноразовое значение для проверки токена
+	Expires time.Time // время окончания действия
+}
+
+// randomString возвращает случайную строку в кодировке base64.
+func randomString(size int) (string, error) {
+	var data = make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// oidc возвращает настройки OpenID Connect, конфигурацию провайдера и
+// конфигурацию клиента OAuth2.
+func (s *Store) oidc() (*OIDCConfig, *oidcProvider, *oauth2.Config, error) {
+	var config = new(OIDCConfig)
+	if err := s.load(sectionConfig, "oidc", config); err == rest.ErrNotFound {
+		return nil, nil, nil, rest.NewError(http.StatusNotFound,
+			"oidc is not configured")
+	} else if err != nil {
+		return nil, nil, nil, err
+	}
+	provider, err := getOIDCProvider(config.Issuer)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var client = &oauth2.Config{
+		ClientID:     config.ID,
+		ClientSecret: config.Secret,
+		RedirectURL:  config.RedirectURL,
+		Scopes:       []string{"openid", "email", "profile"},
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  provider.AuthorizationEndpoint,
+			TokenURL: provider.TokenEndpoint,
+		},
+	}
+	return config, provider, client, nil
+}
+
+// verifyIDToken проверяет подпись, издателя, получателя, время действия и
+// одноразовое значение токена OpenID Connect и возвращает его содержимое.
+func verifyIDToken(config *OIDCConfig, provider *oidcProvider,
+	idToken, nonce string) (map[string]interface{}, error) {
+	claim, err := jwt.Verify(idToken, provider.auth.GetKey)
+	if err != nil {
+		return nil, rest.NewError(http.StatusForbidden, err.Error())
+	}
+	var info = new(struct {
+		Issuer   string   `json:"iss"`
+		Audience Audience `json:"aud"`
+		Expires  int64    `json:"exp"`
+		Nonce    string   `json:"nonce"`
+	})
+	if err := json.Unmarshal(claim, info); err != nil {
+		return nil, err
+	}
+	switch {
+	case info.Issuer != provider.Issuer:
+		return nil, rest.NewError(http.StatusForbidden, "bad oidc token issuer")
+	case !info.Audience.Contains(config.ID):
+		return nil, rest.NewError(http.StatusForbidden, "bad oidc token audience")
+	case time.Now().Unix() > info.Expires:
+		return nil, rest.NewError(http.StatusForbidden, "oidc token expired")
+	case info.Nonce != nonce:
+		return nil, rest.NewError(http.StatusForbidden, "bad oidc token nonce")
+	}
+	var claims = make(map[string]interface{})
+	if err := json.Unmarshal(claim, &claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// oidcAdmin возвращает описание администратора с ролями, определенными по
+// его группам из токена OpenID Connect.
+func oidcAdmin(config *OIDCConfig, claims map[string]interface{}) (*Admin, error) {
+	var nameClaim, groupsClaim = config.NameClaim, config.GroupsClaim
+	if nameClaim == "" {
+		nameClaim = "email"
+	}
+	if groupsClaim == "" {
+		groupsClaim = "groups"
+	}
+	name, _ := claims[nameClaim].(string)
+	if name == "" {
+		return nil, rest.NewError(http.StatusForbidden, "oidc admin name required")
+	}
+	var roles = make([]string, 0)
+	var groups, _ = claims[groupsClaim].([]interface{})
+	for _, group := range groups {
+		if group, ok := group.(string); ok {
+			roles = append(roles, config.Roles[group]...)
+		}
+	}
+	if len(roles) == 0 {
+		return nil, rest.NewError(http.StatusForbidden, "oidc admin has no roles")
+	}
+	return &Admin{Name: name, Roles: roles}, nil
+}
+
+// OIDCLogin перенаправляет администратора на страницу авторизации
+// провайдера OpenID Connect.
+func (s *Store) OIDCLogin(c *rest.Context) error {
+	config, _, client, err := s.oidc()
+	if err != nil {
+		return err
+	}
+	state, err := randomString(16)
+	if err != nil {
+		return err
+	}
+	nonce, err := randomString(16)
+	if err != nil {
+		return err
+	}
+	var now = time.Now()
+	oidcState.mu.Lock()
+	for state, request := range oidcState.list {
+		if now.After(request.Expires) {
+			delete(oidcState.list, state)
+		}
+	}
+	oidcState.list[state] = oidcRequest{
+		Nonce:   nonce,
+		Expires: now.Add(oidcStateTTL),
+	}
+	oidcState.mu.Unlock()
+	setOIDCCookie(c, config, state, int(oidcStateTTL/time.Second))
+	return c.Redirect(http.StatusFound, client.AuthCodeURL(state,
+		oauth2.SetAuthURLParam("nonce", nonce)))
+}
+
+// setOIDCCookie сохраняет в cookie браузера значение state начатой
+// авторизации. Отрицательное время жизни удаляет cookie.
+func setOIDCCookie(c *rest.Context, config *OIDCConfig, state string, maxAge int) {
+	c.SetHeader("Set-Cookie", (&http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/oidc/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure: c.Request.TLS != nil ||
+			strings.HasPrefix(config.RedirectURL, "https:"),
+		// ответ провайдера приходит переходом с другого сайта
+		SameSite: http.SameSiteLaxMode,
+	}).String())
+}
+
+// oidcCheckState возвращает параметры начатой авторизации, если state из
+// запроса совпадает с сохраненным в cookie браузера. Параметры авторизации
+// удаляются, чтобы ответ провайдера нельзя было использовать повторно.
+func oidcCheckState(r *http.Request) (oidcRequest, bool) {
+	var state = r.URL.Query().Get("state")
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || state == "" || subtle.ConstantTimeCompare(
+		[]byte(cookie.Value), []byte(state)) != 1 {
+		return oidcRequest{}, false
+	}
+	oidcState.mu.Lock()
+	var request, ok = oidcState.list[state]
+	delete(oidcState.list, state)
+	oidcState.mu.Unlock()
+	if !ok || time.Now().After(request.Expires) {
+		return oidcRequest{}, false
+	}
+	return request, true
+}
+
+// OIDCCallback обрабатывает ответ провайдера OpenID Connect: получает и
+// проверяет токен, определяет роли администратора по его группам и отдает
+// токен сессии администратора.
+func (s *Store) OIDCCallback(c *rest.Context) error {
+	var query = c.Request.URL.Query()
+	if msg := query.Get("error"); msg != "" {
+		return c.Error(http.StatusForbidden, fmt.Sprintf("oidc error: %s %s",
+			msg, query.Get("error_description")))
+	}
+	config, provider, client, err := s.oidc()
+	if err != nil {
+		return err
+	}
+	setOIDCCookie(c, config, "", -1)
+	request, ok := oidcCheckState(c.Request)
+	if !ok {
+		return c.Error(http.StatusForbidden, "bad oidc state")
+	}
+	var ctx = context.WithValue(c.Request.Context(), oauth2.HTTPClient, httpClient)
+	token, err := client.Exchange(ctx, query.Get("code"))
+	if err != nil {
+		return rest.NewError(http.StatusForbidden, err.Error())
+	}
+	idToken, _ := token.Extra("id_token").(string)
+	if idToken == "" {
+		return c.Error(http.StatusForbidden, "oidc id token required")
+	}
+	claims, err := verifyIDToken(config, provider, idToken, request.Nonce)
+	if err != nil {
+		return err
+	}
+	admin, err := oidcAdmin(config, claims)
+	if err != nil {
+		return err
+	}
+	c.AddLogField("admin", admin.Name)
+	session, expires, err := newAdminSession(admin.Name, admin)
+	if err != nil {
+		return err
+	}
+	auditLog.Info("oidc admin login", "admin", admin.Name, "roles", admin.Roles)
+	return c.Write(rest.JSON{
+		"token":   session,
+		"type":    "Bearer",
+		"expires": expires.UTC(),
+	})
+}
+
+// GetOIDCConfig отдает настройки OpenID Connect без секретного ключа.
+func (s *Store) GetOIDCConfig(c *rest.Context) error {
+	var config = new(OIDCConfig)
+	if err := s.load(sectionConfig, "oidc", config); err != nil &&
+		err != rest.ErrNotFound {
+		return err
+	}
+	config.Secret = ""
+	return c.Write(config)
+}
+
+// SetOIDCConfig задает настройки OpenID Connect. Перед сохранением
+// проверяется доступность конфигурации провайдера.
+func (s *Store) SetOIDCConfig(c *rest.Context) error {
+	var config = new(OIDCConfig)
+	if err := c.Bind(config); err != nil {
+		return c.Error(http.StatusBadRequest, err.Error())
+	}
+	switch {
+	case config.Issuer == "":
+		return c.Error(http.StatusBadRequest, "issuer required")
+	case config.ID == "":
+		return c.Error(http.StatusBadRequest, "id required")
+	case config.RedirectURL == "":
+		return c.Error(http.StatusBadRequest, "redirect required")
+	}
+	for _, roles := range config.Roles {
+		for _, role := range roles {
+			if !roleExists(role) {
+				return c.Error(http.StatusBadRequest, fmt.Sprintf(
+					"unknown admin role %s", role))
+			}
+		}
+	}
+	// конфигурация провайдера запрашивается заново, а не берется из кеша
+	oidcProviders.mu.Lock()
+	delete(oidcProviders.list, config.Issuer)
+	oidcProviders.mu.Unlock()
+	if _, err := getOIDCProvider(config.Issuer); err != nil {
+		return c.Error(http.StatusBadRequest, fmt.Sprintf(
+			"oidc discovery error: %s", err))
+	}
+	return s.save(sectionConfig, "oidc", config)
+}
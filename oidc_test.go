@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// testIdP описывает тестовый провайдер OpenID Connect, который отдает
+// конфигурацию и список ключей.
+type testIdP struct {
+	*httptest.Server
+	key       *rsa.PrivateKey
+	discovery int32 // количество запросов конфигурации
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var idp = &testIdP{key: key}
+	var mux = http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&idp.discovery, 1)
+		json.NewEncoder(w).Encode(&Discovery{
+			Issuer:                idp.URL,
+			AuthorizationEndpoint: idp.URL + "/authorize",
+			TokenEndpoint:         idp.URL + "/token",
+			JWKSURI:               idp.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test",
+				"alg": "RS256",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+// sign возвращает токен с указанным содержимым, подписанный RS256.
+func (idp *testIdP) sign(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	t.Helper()
+	var encode = func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	var payload = encode(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "test"}) +
+		"." + encode(claims)
+	var sum = sha256.Sum256([]byte(payload))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestOIDCProviderCache(t *testing.T) {
+	var idp = newTestIdP(t)
+	for i := 0; i < 3; i++ {
+		provider, err := getOIDCProvider(idp.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if provider.JWKSURI != idp.URL+"/keys" || provider.auth == nil {
+			t.Fatalf("bad provider %+v", provider)
+		}
+	}
+	if n := atomic.LoadInt32(&idp.discovery); n != 1 {
+		t.Fatalf("discovery requested %d times", n)
+	}
+	// по истечении времени кеширования конфигурация запрашивается заново
+	oidcProviders.mu.Lock()
+	oidcProviders.list[idp.URL].expires = time.Now().Add(-time.Second)
+	oidcProviders.mu.Unlock()
+	if _, err := getOIDCProvider(idp.URL); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&idp.discovery); n != 2 {
+		t.Fatalf("discovery requested %d times", n)
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	var idp = newTestIdP(t)
+	provider, err := getOIDCProvider(idp.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config = &OIDCConfig{Issuer: idp.URL, ID: "client"}
+	var claims = func(change func(map[string]interface{})) map[string]interface{} {
+		var claims = map[string]interface{}{
+			"iss":   idp.URL,
+			"aud":   "client",
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"nonce": "nonce",
+			"email": "admin@test.com",
+		}
+		if change != nil {
+			change(claims)
+		}
+		return claims
+	}
+	for _, test := range []struct {
+		name  string
+		key   *rsa.PrivateKey
+		token map[string]interface{}
+		valid bool
+	}{
+		{"valid", idp.key, claims(nil), true},
+		{"audience list", idp.key, claims(func(c map[string]interface{}) {
+			c["aud"] = []string{"other", "client"}
+		}), true},
+		{"bad signature", other, claims(nil), false},
+		{"bad issuer", idp.key, claims(func(c map[string]interface{}) {
+			c["iss"] = "https://example.com"
+		}), false},
+		{"bad audience", idp.key, claims(func(c map[string]interface{}) {
+			c["aud"] = "other"
+		}), false},
+		{"expired", idp.key, claims(func(c map[string]interface{}) {
+			c["exp"] = time.Now().Add(-time.Minute).Unix()
+		}), false},
+		{"bad nonce", idp.key, claims(func(c map[string]interface{}) {
+			c["nonce"] = "other"
+		}), false},
+	} {
+		result, err := verifyIDToken(config, provider, idp.sign(t, test.key, test.token), "nonce")
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if test.valid && result["email"] != "admin@test.com" {
+			t.Errorf("%s: bad claims %v", test.name, result)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: token accepted", test.name)
+		}
+	}
+}
+
+func TestOIDCAdmin(t *testing.T) {
+	var config = &OIDCConfig{Roles: map[string][]string{
+		"admins":  {roleSuperAdmin},
+		"support": {roleUserManager, roleReadOnly},
+	}}
+	admin, err := oidcAdmin(config, map[string]interface{}{
+		"email":  "admin@test.com",
+		"groups": []interface{}{"support", "unknown"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if admin.Name != "admin@test.com" || len(admin.Roles) != 2 ||
+		admin.Allowed("backup", "GET") || !admin.Allowed("users", "PUT") {
+		t.Fatalf("bad admin %+v", admin)
+	}
+	for _, claims := range []map[string]interface{}{
+		{"email": "admin@test.com", "groups": []interface{}{"unknown"}},
+		{"email": "admin@test.com"},
+		{"groups": []interface{}{"admins"}},
+	} {
+		if _, err := oidcAdmin(config, claims); err == nil {
+			t.Errorf("admin accepted: %v", claims)
+		}
+	}
+}
+
+func TestOIDCConfigured(t *testing.T) {
+	var store = testStore(t)
+	var configured = func() (result bool) {
+		store.db.View(func(tx *bolt.Tx) error {
+			result = oidcConfigured(tx)
+			return nil
+		})
+		return result
+	}
+	if configured() {
+		t.Fatal("oidc configured in empty store")
+	}
+	if err := store.save(sectionConfig, "oidc", &OIDCConfig{Issuer: "https://example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	// без администраторов, но с настроенным OpenID Connect авторизация
+	// администратора обязательна
+	if !configured() {
+		t.Fatal("oidc not configured")
+	}
+}
+
+func TestOIDCCheckState(t *testing.T) {
+	var request = func(state, cookie string) *http.Request {
+		var r = httptest.NewRequest("GET", "/oidc/callback?code=x&state="+state, nil)
+		if cookie != "" {
+			r.AddCookie(&http.Cookie{Name: oidcStateCookie, Value: cookie})
+		}
+		return r
+	}
+	oidcState.mu.Lock()
+	oidcState.list["state"] = oidcRequest{Nonce: "nonce",
+		Expires: time.Now().Add(oidcStateTTL)}
+	oidcState.list["expired"] = oidcRequest{Nonce: "nonce",
+		Expires: time.Now().Add(-time.Minute)}
+	oidcState.mu.Unlock()
+	// ответ провайдера без cookie или с чужим state отклоняется и не
+	// расходует начатую авторизацию
+	for _, r := range []*http.Request{
+		request("state", ""),
+		request("state", "other"),
+		request("", ""),
+	} {
+		if _, ok := oidcCheckState(r); ok {
+			t.Fatalf("state accepted: %v", r.Cookies())
+		}
+	}
+	if _, ok := oidcCheckState(request("expired", "expired")); ok {
+		t.Fatal("expired state accepted")
+	}
+	result, ok := oidcCheckState(request("state", "state"))
+	if !ok || result.Nonce != "nonce" {
+		t.Fatalf("state rejected: %+v", result)
+	}
+	if _, ok := oidcCheckState(request("state", "state")); ok {
+		t.Fatal("state replayed")
+	}
+}
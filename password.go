@@ -2,33 +2,54 @@ package main
 
 import (
 	"crypto/rand"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"sort"
 
-	"golang.org/x/crypto/bcrypt"
+	"github.com/mdigger/rest"
+	bolt "go.etcd.io/bbolt"
 )
 
+// StrictPasswords запрещает сравнение с паролями, сохраненными в открытом
+// виде без хеширования.
+var StrictPasswords = false
+
 // Password описывает строку с паролем. При сохранении в хранилище она
-// всегда преобразуется в bcrypt-hash.
+// всегда преобразуется в хеш с помощью DefaultHasher.
 type Password string
 
-// MarshalText преобразует строку с паролем в bcrypt-hash, если это не было
-// сделано до этого. В противном случае строка остается в неизменном виде.
+// MarshalText преобразует строку с паролем в хеш, если это не было сделано
+// до этого. В противном случае строка остается в неизменном виде.
 func (p Password) MarshalText() ([]byte, error) {
 	var data = []byte(p)
-	if _, err := bcrypt.Cost(data); err == nil {
+	if p.Hashed() {
 		return data, nil
 	}
-	return bcrypt.GenerateFromPassword(data, bcrypt.DefaultCost)
+	return DefaultHasher.Hash(data)
+}
+
+// Hashed возвращает true, если пароль уже представлен в виде хеша одного из
+// поддерживаемых алгоритмов.
+func (p Password) Hashed() bool {
+	return hasherFor([]byte(p)) != nil
+}
+
+// NeedsRehash возвращает true, если пароль не хеширован или хеш получен с
+// помощью алгоритма или параметров, отличных от DefaultHasher.
+func (p Password) NeedsRehash() bool {
+	return DefaultHasher.Outdated([]byte(p))
 }
 
 // Compare возвращает true, если пароль совпадает с указанным в параметре.
 func (p Password) Compare(password string) bool {
 	var data = []byte(p)
+	var hasher = hasherFor(data)
 	// если пароль не хеширован, то просто сравниваем строки
-	if _, err := bcrypt.Cost(data); err != nil {
-		return string(p) == password
+	if hasher == nil {
+		return !StrictPasswords && string(p) == password
 	}
-	return bcrypt.CompareHashAndPassword(data, []byte(password)) == nil
+	return hasher.Verify(data, []byte(password))
 }
 
 // NewPassword возвращает новый случайный пароль для пользователя.
@@ -42,3 +63,130 @@ func NewPassword() Password {
 	return Password(fmt.Sprintf("%s-%s-%s-%s",
 		bytes[:3], bytes[3:6], bytes[6:9], bytes[9:12]))
 }
+
+// rehashPassword заменяет сохраненный хеш пароля пользователя или
+// администратора на хеш с текущими параметрами DefaultHasher. Запись заново
+// читается в той же транзакции, и в ней изменяется только пароль; если он
+// был изменен после проверки, то запись остается без изменений.
+func (s *Store) rehashPassword(section, name string, old Password, password string) error {
+	hash, err := DefaultHasher.Hash([]byte(password))
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		var bucket = tx.Bucket([]byte(section))
+		if bucket == nil {
+			return nil
+		}
+		var data = bucket.Get([]byte(name))
+		if data == nil {
+			return nil
+		}
+		var obj interface{} // пользователь или администратор
+		if section == sectionUsers {
+			var user = new(User)
+			if err := json.Unmarshal(data, user); err != nil {
+				return err
+			}
+			if user.Password != old {
+				return nil
+			}
+			user.Password = Password(hash)
+			obj = user
+		} else {
+			admin, err := decodeAdmin(name, data)
+			if err != nil {
+				return err
+			}
+			if admin.Password != old {
+				return nil
+			}
+			admin.Password = Password(hash)
+			obj = admin
+		}
+		data, err := json.MarshalIndent(obj, "", "    ")
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(name), data)
+	})
+}
+
+// Plaintext возвращает списки пользователей и администраторов, пароли
+// которых сохранены в открытом виде. Если установлен флаг fix, то такие
+// пароли заменяются на хеши.
+func (s *Store) Plaintext(fix bool) (map[string][]string, error) {
+	var result = make(map[string][]string)
+	var fn = s.db.View
+	if fix {
+		fn = s.db.Update
+	}
+	if err := fn(func(tx *bolt.Tx) error {
+		for _, section := range []string{sectionUsers, sectionAdmins} {
+			var bucket = tx.Bucket([]byte(section))
+			if bucket == nil {
+				continue
+			}
+			var names []string
+			var updated = make(map[string][]byte)
+			if err := bucket.ForEach(func(k, v []byte) error {
+				var obj interface{} // пользователь или администратор
+				var password Password
+				if section == sectionUsers {
+					var user = new(User)
+					if err := json.Unmarshal(v, user); err != nil {
+						return err
+					}
+					obj, password = user, user.Password
+				} else {
+					admin, err := decodeAdmin(string(k), v)
+					if err != nil {
+						return err
+					}
+					obj, password = admin, admin.Password
+				}
+				if password == "" || password.Hashed() {
+					return nil
+				}
+				names = append(names, string(k))
+				if !fix {
+					return nil
+				}
+				// пароль хешируется при преобразовании в JSON
+				data, err := json.MarshalIndent(obj, "", "    ")
+				if err != nil {
+					return err
+				}
+				updated[string(k)] = data
+				return nil
+			}); err != nil {
+				return err
+			}
+			if len(names) == 0 {
+				continue
+			}
+			for name, data := range updated {
+				if err := bucket.Put([]byte(name), data); err != nil {
+					return err
+				}
+			}
+			sort.Strings(names)
+			result[section] = names
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// PlaintextReport отдает списки пользователей и администраторов, пароли
+// которых сохранены в открытом виде. При запросе с методом POST такие пароли
+// заменяются на хеши.
+func (s *Store) PlaintextReport(c *rest.Context) error {
+	report, err := s.Plaintext(c.Request.Method == http.MethodPost)
+	if err != nil {
+		return err
+	}
+	return c.Write(report)
+}
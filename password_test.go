@@ -0,0 +1,106 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlaintext(t *testing.T) {
+	var store = testStore(t)
+	for name, data := range map[string]string{
+		"plain@test.com":  `{"password": "secret", "group": "test"}`,
+		"hashed@test.com": `{"password": "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy", "group": "test"}`,
+	} {
+		if err := store.save(sectionUsers, name, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.save(sectionAdmins, "admin", []byte(`{"password": "admin"}`)); err != nil {
+		t.Fatal(err)
+	}
+	var want = map[string][]string{
+		sectionUsers:  {"plain@test.com"},
+		sectionAdmins: {"admin"},
+	}
+	// без исправления пароли остаются в открытом виде
+	for i := 0; i < 2; i++ {
+		report, err := store.Plaintext(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(report, want) {
+			t.Fatalf("report %v, want %v", report, want)
+		}
+	}
+	report, err := store.Plaintext(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Fatalf("report %v, want %v", report, want)
+	}
+	user, err := store.User("plain@test.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.Password.Hashed() || !user.Password.Compare("secret") {
+		t.Fatalf("password not hashed: %q", user.Password)
+	}
+	admin, err := store.Admin("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !admin.Password.Hashed() || !admin.Password.Compare("admin") {
+		t.Fatalf("admin password not hashed: %q", admin.Password)
+	}
+	if report, err = store.Plaintext(false); err != nil {
+		t.Fatal(err)
+	} else if len(report) != 0 {
+		t.Fatalf("unexpected report %v", report)
+	}
+}
+
+func TestRehashPassword(t *testing.T) {
+	var store = testStore(t)
+	// пароль сохранен в открытом виде, а после его проверки администратор
+	// отключил пользователя
+	if err := store.save(sectionUsers, "user@test.com",
+		`{"group":"test","password":"secret","disabled":true}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.rehashPassword(sectionUsers, "user@test.com", "secret", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	user, err := store.User("user@test.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.Disabled || user.Group != "test" || !user.Password.Hashed() || !user.Password.Compare("secret") {
+		t.Fatalf("bad user after rehash %+v", user)
+	}
+	// пароль, измененный после проверки, не заменяется
+	var hash = user.Password
+	if err := store.rehashPassword(sectionUsers, "user@test.com", "secret", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if user, err = store.User("user@test.com"); err != nil {
+		t.Fatal(err)
+	}
+	if user.Password != hash {
+		t.Fatal("changed password replaced")
+	}
+	// администратор в старом формате сохраняется в новом
+	if err := store.save(sectionAdmins, "admin", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.rehashPassword(sectionAdmins, "admin", "secret", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	admin, err := store.Admin("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !admin.Password.Hashed() || !admin.Password.Compare("secret") {
+		t.Fatalf("bad admin after rehash %+v", admin)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/mdigger/rest"
+)
+
+var passwordPolicy = &PasswordPolicy{MinLength: 8, NotEmail: true}
+
+// PasswordPolicy описывает требования к паролям пользователей и
+// администраторов.
+type PasswordPolicy struct {
+	MinLength int    `json:"minLength"`          // минимальная длина
+	Upper     bool   `json:"upper"`              // заглавные буквы
+	Lower     bool   `json:"lower"`              // строчные буквы
+	Digit     bool   `json:"digit"`              // цифры
+	Special   bool   `json:"special"`            // специальные символы
+	NotEmail  bool   `json:"notEmail"`           // не совпадает с email
+	DenyList  string `json:"denyList,omitempty"` // файл с запрещенными паролями
+	denied    map[string]bool
+	mu        sync.RWMutex
+}
+
+// Названия правил, используемых при проверке пароля.
+const (
+	ruleMinLength = "minLength"
+	ruleUpper     = "upper"
+	ruleLower     = "lower"
+	ruleDigit     = "digit"
+	ruleSpecial   = "special"
+	ruleNotEmail  = "notEmail"
+	ruleDenyList  = "denyList"
+)
+
+// loadDenyList загружает список запрещенных паролей из файла. Каждый пароль
+// задается на отдельной строке; регистр символов не учитывается.
+func loadDenyList(filename string) (map[string]bool, error) {
+	if filename == "" {
+		return nil, nil
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var denied = make(map[string]bool)
+	var scanner = bufio.NewScanner(file)
+	for scanner.Scan() {
+		var line = strings.TrimSpace(scanner.Text())
+		if line != "" {
+			denied[strings.ToLower(line)] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return denied, nil
+}
+
+// Set заменяет требования к паролям на новые и загружает список запрещенных
+// паролей.
+func (p *PasswordPolicy) Set(policy *PasswordPolicy) error {
+	denied, err := loadDenyList(policy.DenyList)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.MinLength = policy.MinLength
+	p.Upper = policy.Upper
+	p.Lower = policy.Lower
+	p.Digit = policy.Digit
+	p.Special = policy.Special
+	p.NotEmail = policy.NotEmail
+	p.DenyList = policy.DenyList
+	p.denied = denied
+	p.mu.Unlock()
+	return nil
+}
+
+// Check проверяет пароль на соответствие требованиям и возвращает список
+// названий не выполненных правил.
+func (p *PasswordPolicy) Check(password, email string) []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var upper, lower, digit, special bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case !unicode.IsSpace(r):
+			special = true
+		}
+	}
+	var unmet = make([]string, 0)
+	if len([]rune(password)) < p.MinLength {
+		unmet = append(unmet, ruleMinLength)
+	}
+	if p.Upper && !upper {
+		unmet = append(unmet, ruleUpper)
+	}
+	if p.Lower && !lower {
+		unmet = append(unmet, ruleLower)
+	}
+	if p.Digit && !digit {
+		unmet = append(unmet, ruleDigit)
+	}
+	if p.Special && !special {
+		unmet = append(unmet, ruleSpecial)
+	}
+	if p.NotEmail && email != "" && strings.EqualFold(password, email) {
+		unmet = append(unmet, ruleNotEmail)
+	}
+	if p.denied[strings.ToLower(password)] {
+		unmet = append(unmet, ruleDenyList)
+	}
+	return unmet
+}
+
+// PolicyError описывает ошибку проверки пароля на соответствие требованиям.
+type PolicyError struct {
+	Unmet []string // названия не выполненных правил
+}
+
+// Error возвращает описание ошибки со списком не выполненных правил.
+func (e *PolicyError) Error() string {
+	return "password policy: " + strings.Join(e.Unmet, ", ")
+}
+
+// checkPassword возвращает ошибку PolicyError, если пароль не соответствует
+// требованиям. Пароли, уже представленные в виде хеша, не проверяются:
+// такие пароли принимаются только через административный API.
+func checkPassword(password Password, email string) error {
+	if password.Hashed() {
+		return nil
+	}
+	var unmet = passwordPolicy.Check(string(password), email)
+	if len(unmet) == 0 {
+		return nil
+	}
+	return &PolicyError{Unmet: unmet}
+}
+
+// passwordError отдает ошибку PolicyError в виде JSON со списком не
+// выполненных правил. Остальные ошибки возвращаются без изменения.
+func passwordError(c *rest.Context, err error) error {
+	if err, ok := err.(*PolicyError); ok {
+		return c.Status(http.StatusBadRequest).Write(rest.JSON{
+			"error": "password policy",
+			"unmet": err.Unmet,
+		})
+	}
+	return err
+}
+
+// LoadPasswordPolicy загружает из хранилища требования к паролям, если они
+// были заданы.
+func (s *Store) LoadPasswordPolicy() error {
+	var policy = new(PasswordPolicy)
+	switch err := s.load(sectionConfig, "password", policy); err {
+	case nil:
+		return passwordPolicy.Set(policy)
+	case rest.ErrNotFound:
+		return nil
+	default:
+		return err
+	}
+}
+
+// GetPasswordPolicy отдает текущие требования к паролям.
+func (s *Store) GetPasswordPolicy(c *rest.Context) error {
+	passwordPolicy.mu.RLock()
+	defer passwordPolicy.mu.RUnlock()
+	return c.Write(passwordPolicy)
+}
+
+// PublicPasswordPolicy отдает текущие требования к паролям без указания
+// файла со списком запрещенных паролей.
+func (s *Store) PublicPasswordPolicy(c *rest.Context) error {
+	passwordPolicy.mu.RLock()
+	defer passwordPolicy.mu.RUnlock()
+	return c.Write(rest.JSON{
+		"minLength": passwordPolicy.MinLength,
+		"upper":     passwordPolicy.Upper,
+		"lower":     passwordPolicy.Lower,
+		"digit":     passwordPolicy.Digit,
+		"special":   passwordPolicy.Special,
+		"notEmail":  passwordPolicy.NotEmail,
+	})
+}
+
+// SetPasswordPolicy задает новые требования к паролям.
+func (s *Store) SetPasswordPolicy(c *rest.Context) error {
+	var policy = new(PasswordPolicy)
+	if err := c.Bind(policy); err != nil {
+		return c.Error(http.StatusBadRequest, err.Error())
+	}
+	if policy.MinLength < 1 {
+		return c.Error(http.StatusBadRequest, "bad password min length")
+	}
+	if err := passwordPolicy.Set(policy); err != nil {
+		return c.Error(http.StatusBadRequest, err.Error())
+	}
+	return s.save(sectionConfig, "password", policy)
+}
+
+// CheckPasswordPolicy проверяет пароль на соответствие требованиям и отдает
+// список не выполненных правил.
+func (s *Store) CheckPasswordPolicy(c *rest.Context) error {
+	var data = new(struct {
+		Password string `json:"password"`
+		Email    string `json:"email"`
+	})
+	if err := c.Bind(data); err != nil {
+		return c.Error(http.StatusBadRequest, err.Error())
+	}
+	var unmet = passwordPolicy.Check(data.Password, data.Email)
+	return c.Write(rest.JSON{"valid": len(unmet) == 0, "unmet": unmet})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	var filename = filepath.Join(t.TempDir(), "deny.txt")
+	if err := os.WriteFile(filename, []byte("Password1!\n\nqwerty\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var policy = new(PasswordPolicy)
+	if err := policy.Set(&PasswordPolicy{MinLength: 8, Upper: true, Lower: true,
+		Digit: true, Special: true, NotEmail: true, DenyList: filename}); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		password, email string
+		unmet           []string
+	}{
+		{"Str0ng-pass", "", []string{}},
+		{"short", "", []string{ruleMinLength, ruleUpper, ruleDigit, ruleSpecial}},
+		{"PASSWORD-1", "", []string{ruleLower}},
+		{"password2!", "", []string{ruleUpper}},
+		{"PASSWORD1!", "", []string{ruleLower, ruleDenyList}},
+		{"Us3r@test.com", "us3r@test.com", []string{ruleNotEmail}},
+	} {
+		if unmet := policy.Check(test.password, test.email); !reflect.DeepEqual(unmet, test.unmet) {
+			t.Errorf("%q: unmet %v, want %v", test.password, unmet, test.unmet)
+		}
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	if err := checkPassword("short", ""); err == nil {
+		t.Fatal("short password accepted")
+	} else if err, ok := err.(*PolicyError); !ok ||
+		!reflect.DeepEqual(err.Unmet, []string{ruleMinLength}) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := checkPassword("long enough", ""); err != nil {
+		t.Fatal(err)
+	}
+	// хеши проверяются только при загрузке через административный API
+	hash, err := DefaultHasher.Hash([]byte("short"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkPassword(Password(hash), ""); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mdigger/rest"
+)
+
+// SelfService описывает, какие поля профиля и ключи дополнительных данных
+// пользователь может изменять самостоятельно. Ключ `*` разрешает изменение
+// любых дополнительных данных. По умолчанию изменения запрещены.
+type SelfService struct {
+	Profile []string `json:"profile"` // поля профиля
+	Data    []string `json:"data"`    // ключи дополнительных данных
+}
+
+// profileFields содержит поля профиля, которые могут быть разрешены для
+// самостоятельного изменения пользователем.
+var profileFields = map[string]bool{"name": true}
+
+// allowed возвращает true, если ключ присутствует в списке или список
+// содержит `*`.
+func allowed(list []string, key string) bool {
+	for _, name := range list {
+		if name == key || name == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// selfService возвращает текущие разрешения на изменение данных
+// пользователями.
+func (s *Store) selfService() (*SelfService, error) {
+	var config = new(SelfService)
+	switch err := s.load(sectionConfig, "selfservice", config); err {
+	case nil, rest.ErrNotFound:
+		return config, nil
+	default:
+		return nil, err
+	}
+}
+
+// GetSelfService отдает текущие разрешения на изменение данных
+// пользователями.
+func (s *Store) GetSelfService(c *rest.Context) error {
+	config, err := s.selfService()
+	if err != nil {
+		return err
+	}
+	return c.Write(config)
+}
+
+// SetSelfService задает разрешения на изменение данных пользователями.
+func (s *Store) SetSelfService(c *rest.Context) error {
+	var config = new(SelfService)
+	if err := c.Bind(config); err != nil {
+		return c.Error(http.StatusBadRequest, err.Error())
+	}
+	for _, field := range config.Profile {
+		if !profileFields[field] {
+			return c.Error(http.StatusBadRequest, "unknown profile field: "+field)
+		}
+	}
+	for _, key := range config.Data {
+		if key == "" {
+			return c.Error(http.StatusBadRequest, "empty user data key")
+		}
+	}
+	return s.save(sectionConfig, "selfservice", config)
+}
+
+// forbiddenKeys возвращает отсортированный список ключей, изменение которых
+// не разрешено.
+func forbiddenKeys(data rest.JSON, list []string) []string {
+	var keys []string
+	for key := range data {
+		if !allowed(list, key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// UserProfilePatch изменяет разрешенные администратором поля профиля
+// авторизованного пользователя. Поля со значением null очищаются.
+func (s *Store) UserProfilePatch(c *rest.Context) error {
+	user, err := s.AuthUser(c)
+	if err != nil {
+		return err
+	}
+	var patch = make(rest.JSON)
+	if err := c.Bind(&patch); err != nil {
+		return c.Error(http.StatusBadRequest, err.Error())
+	}
+	config, err := s.selfService()
+	if err != nil {
+		return err
+	}
+	if keys := forbiddenKeys(patch, config.Profile); len(keys) > 0 {
+		return c.Error(http.StatusForbidden,
+			"profile fields not allowed: "+strings.Join(keys, ", "))
+	}
+	value, rename := patch["name"]
+	name, ok := value.(string)
+	if rename && value != nil && !ok {
+		return c.Error(http.StatusBadRequest, "bad user name")
+	}
+	// изменяются только переданные поля профиля, а остальные берутся из
+	// хранилища, а не из загруженной при авторизации копии
+	return s.updateUser(user.Email, func(user *User) error {
+		if rename {
+			user.Name = strings.TrimSpace(name)
+		}
+		user.Updated = time.Now().UTC()
+		return nil
+	})
+}
+
+// UserDataUpdate изменяет разрешенные администратором ключи дополнительных
+// данных авторизованного пользователя. Запрос PATCH объединяет данные с
+// переданными, а PUT, кроме того, удаляет разрешенные ключи, отсутствующие
+// в запросе. Остальные ключи при этом не изменяются.
+func (s *Store) UserDataUpdate(c *rest.Context) error {
+	user, err := s.AuthUser(c)
+	if err != nil {
+		return err
+	}
+	var patch = make(rest.JSON)
+	if err := c.Bind(&patch); err != nil {
+		return c.Error(http.StatusBadRequest, err.Error())
+	}
+	config, err := s.selfService()
+	if err != nil {
+		return err
+	}
+	if keys := forbiddenKeys(patch, config.Data); len(keys) > 0 {
+		return c.Error(http.StatusForbidden,
+			"user data keys not allowed: "+strings.Join(keys, ", "))
+	}
+	var replace = c.Request.Method == http.MethodPut
+	return s.updateUserData(user.Email, func(userData rest.JSON) {
+		if replace {
+			for key := range userData {
+				if _, ok := patch[key]; !ok && allowed(config.Data, key) {
+					delete(userData, key)
+				}
+			}
+		}
+		mergeUserData(userData, patch)
+	})
+}
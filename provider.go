@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdigger/log"
+	"github.com/mdigger/rest"
+)
+
+// Provider описывает доверенного провайдера токенов OpenID Connect/JWT,
+// которые принимаются для авторизации пользователей.
+type Provider struct {
+	// список допустимых значений iss; `{tenantid}` заменяет идентификатор
+	// организации
+	Issuers []string `json:"issuers"`
+	// адрес провайдера для получения конфигурации OpenID Connect
+	Discovery string `json:"discovery,omitempty"`
+	// адрес для получения списка ключей; если не задан, то берется из
+	// конфигурации провайдера
+	JWKS        string `json:"jwks,omitempty"`
+	UserClaim   string `json:"userClaim"`             // идентификатор пользователя
+	TenantClaim string `json:"tenantClaim,omitempty"` // идентификатор организации
+	// допустимые значения aud для всех организаций
+	Audiences []string `json:"audiences,omitempty"`
+	// допустимые значения aud для отдельных организаций
+	TenantAudiences map[string][]string `json:"tenantAudiences,omitempty"`
+	keys            *Auth               // ключи для проверки подписи
+	mu              sync.Mutex
+}
+
+// ClockSkew задает допустимое расхождение времени при проверке времени
+// действия токенов.
+var ClockSkew = time.Minute * 5
+
+// AzureAudiences задает допустимые значения aud для предопределенного
+// провайдера Azure AD.
+var AzureAudiences []string
+
+// Предопределенные провайдеры токенов.
+const providerAzure = "azure"
+
+// defaultProviders возвращает список предопределенных провайдеров.
+func defaultProviders() map[string]*Provider {
+	return map[string]*Provider{
+		providerAzure: {
+			Issuers: []string{
+				"https://login.microsoftonline.com/{tenantid}/v2.0",
+				"https://sts.windows.net/{tenantid}/",
+			},
+			JWKS:        jwksURL,
+			UserClaim:   "upn",
+			TenantClaim: "tid",
+			Audiences:   AzureAudiences,
+			keys:        authKeys,
+		},
+	}
+}
+
+// tokenProviders содержит список доверенных провайдеров токенов.
+var tokenProviders = struct {
+	list map[string]*Provider
+	mu   sync.RWMutex
+}{list: defaultProviders()}
+
+// matchIssuer проверяет, что значение iss соответствует шаблону, и
+// возвращает идентификатор организации из него, если он задан в шаблоне.
+func matchIssuer(pattern, issuer string) (string, bool) {
+	const placeholder = "{tenantid}"
+	var i = strings.Index(pattern, placeholder)
+	if i < 0 {
+		return "", pattern == issuer
+	}
+	var prefix, suffix = pattern[:i], pattern[i+len(placeholder):]
+	if len(issuer) <= len(prefix)+len(suffix) ||
+		!strings.HasPrefix(issuer, prefix) || !strings.HasSuffix(issuer, suffix) {
+		return "", false
+	}
+	var tenant = issuer[len(prefix) : len(issuer)-len(suffix)]
+	if strings.ContainsRune(tenant, '/') {
+		return "", false
+	}
+	return tenant, true
+}
+
+// Auth возвращает ключи для проверки подписи токенов провайдера. Если адрес
+// списка ключей не задан, то он запрашивается из конфигурации провайдера.
+func (p *Provider) Auth() (*Auth, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.keys != nil {
+		return p.keys, nil
+	}
+	var url = p.JWKS
+	if url == "" {
+		discovery, err := GetDiscovery(p.Discovery)
+		if err != nil {
+			return nil, err
+		}
+		url = discovery.JWKSURI
+	}
+	p.keys = NewAuth(url)
+	return p.keys, nil
+}
+
+// tokenIssuer возвращает значение iss из токена без проверки его подписи.
+func tokenIssuer(token string) (string, error) {
+	var parts = strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("bad token format")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+	var claims = new(struct {
+		Issuer string `json:"iss"`
+	})
+	if err := json.Unmarshal(data, claims); err != nil {
+		return "", err
+	}
+	return claims.Issuer, nil
+}
+
+// findProvider возвращает название и описание провайдера, выдавшего токен, а
+// также идентификатор организации из значения iss, если он в нем задан.
+func findProvider(token string) (string, *Provider, string, error) {
+	issuer, err := tokenIssuer(token)
+	if err != nil {
+		return "", nil, "", err
+	}
+	tokenProviders.mu.RLock()
+	defer tokenProviders.mu.RUnlock()
+	for name, provider := range tokenProviders.list {
+		for _, pattern := range provider.Issuers {
+			if tenant, ok := matchIssuer(pattern, issuer); ok {
+				return name, provider, tenant, nil
+			}
+		}
+	}
+	return "", nil, "", fmt.Errorf("untrusted token issuer %s", issuer)
+}
+
+// Validate проверяет время действия токена и его получателя. Для организаций,
+// для которых заданы отдельные значения aud, используются только они.
+func (p *Provider) Validate(claims map[string]interface{}, tenant string) error {
+	var now = time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("token expiration required")
+	}
+	if now.Add(-ClockSkew).After(time.Unix(int64(exp), 0)) {
+		return errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok &&
+		now.Add(ClockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token not valid yet")
+	}
+	var audiences = p.Audiences
+	if list, ok := p.TenantAudiences[tenant]; ok && tenant != "" {
+		audiences = list
+	}
+	if len(audiences) == 0 {
+		return errors.New("token audience is not configured")
+	}
+	var aud Audience
+	switch value := claims["aud"].(type) {
+	case string:
+		aud = Audience{value}
+	case []interface{}:
+		for _, value := range value {
+			if value, ok := value.(string); ok {
+				aud = append(aud, value)
+			}
+		}
+	}
+	for _, audience := range audiences {
+		if aud.Contains(audience) {
+			return nil
+		}
+	}
+	return errors.New("bad token audience")
+}
+
+// claimString возвращает строковое значение поля токена.
+func claimString(claims map[string]interface{}, name string) string {
+	value, _ := claims[name].(string)
+	return value
+}
+
+// setProviders объединяет предопределенных провайдеров с указанными и
+// устанавливает их в качестве текущих. Провайдер со значением null удаляется.
+func setProviders(providers map[string]*Provider) {
+	var list = defaultProviders()
+	for name, provider := range providers {
+		if provider == nil {
+			delete(list, name)
+		} else {
+			list[name] = provider
+		}
+	}
+	tokenProviders.mu.Lock()
+	tokenProviders.list = list
+	tokenProviders.mu.Unlock()
+}
+
+// unconfiguredProviders возвращает отсортированный список провайдеров, для
+// которых не заданы допустимые значения aud. Токены таких провайдеров не
+// принимаются.
+func unconfiguredProviders() []string {
+	tokenProviders.mu.RLock()
+	defer tokenProviders.mu.RUnlock()
+	var names []string
+	for name, provider := range tokenProviders.list {
+		if len(provider.Audiences) == 0 && len(provider.TenantAudiences) == 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadProviders загружает из хранилища список доверенных провайдеров токенов.
+func (s *Store) LoadProviders() error {
+	var providers = make(map[string]*Provider)
+	switch err := s.load(sectionConfig, "providers", &providers); err {
+	case nil:
+		setProviders(providers)
+	case rest.ErrNotFound:
+	default:
+		return err
+	}
+	return nil
+}
+
+// GetProviders отдает список доверенных провайдеров токенов.
+func (s *Store) GetProviders(c *rest.Context) error {
+	tokenProviders.mu.RLock()
+	defer tokenProviders.mu.RUnlock()
+	return c.Write(tokenProviders.list)
+}
+
+// SetProviders задает дополнительных доверенных провайдеров токенов или
+// переопределяет предопределенных.
+func (s *Store) SetProviders(c *rest.Context) error {
+	var providers = make(map[string]*Provider)
+	if err := c.Bind(&providers); err != nil {
+		return c.Error(http.StatusBadRequest, err.Error())
+	}
+	for name, provider := range providers {
+		if provider == nil {
+			continue
+		}
+		switch {
+		case len(provider.Issuers) == 0:
+			return c.Error(http.StatusBadRequest, fmt.Sprintf(
+				"provider %s issuers required", name))
+		case provider.JWKS == "" && provider.Discovery == "":
+			return c.Error(http.StatusBadRequest, fmt.Sprintf(
+				"provider %s jwks or discovery required", name))
+		case provider.UserClaim == "":
+			return c.Error(http.StatusBadRequest, fmt.Sprintf(
+				"provider %s user claim required", name))
+		}
+	}
+	if err := s.save(sectionConfig, "providers", providers); err != nil {
+		return err
+	}
+	setProviders(providers)
+	if names := unconfiguredProviders(); len(names) > 0 {
+		log.Warn("token providers without audiences reject all tokens",
+			"providers", names)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestProviderValidate(t *testing.T) {
+	var exp = float64(time.Now().Add(time.Minute).Unix())
+	var provider = &Provider{
+		Audiences:       []string{"app"},
+		TenantAudiences: map[string][]string{"tenant": {"tenant-app"}},
+	}
+	for _, test := range []struct {
+		name   string
+		claims map[string]interface{}
+		tenant string
+		valid  bool
+	}{
+		{"audience", map[string]interface{}{"exp": exp, "aud": "app"}, "", true},
+		{"audience list", map[string]interface{}{"exp": exp, "aud": []interface{}{"x", "app"}}, "", true},
+		{"bad audience", map[string]interface{}{"exp": exp, "aud": "other"}, "", false},
+		{"no audience", map[string]interface{}{"exp": exp}, "", false},
+		{"tenant audience", map[string]interface{}{"exp": exp, "aud": "tenant-app"}, "tenant", true},
+		{"tenant only", map[string]interface{}{"exp": exp, "aud": "app"}, "tenant", false},
+		{"expired", map[string]interface{}{"exp": float64(time.Now().Add(-time.Hour).Unix()), "aud": "app"}, "", false},
+		{"no expiration", map[string]interface{}{"aud": "app"}, "", false},
+	} {
+		if err := provider.Validate(test.claims, test.tenant); (err == nil) != test.valid {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+	// без настроенных значений aud токены не принимаются
+	if err := new(Provider).Validate(map[string]interface{}{"exp": exp, "aud": "app"}, ""); err == nil {
+		t.Error("token accepted without configured audiences")
+	}
+}
+
+func TestUnconfiguredProviders(t *testing.T) {
+	defer setProviders(nil)
+	setProviders(map[string]*Provider{
+		"google": {Audiences: []string{"app"}},
+		"corp":   {},
+	})
+	var want = []string{"corp"}
+	if len(AzureAudiences) == 0 {
+		want = []string{"azure", "corp"}
+	}
+	if names := unconfiguredProviders(); !reflect.DeepEqual(names, want) {
+		t.Fatalf("unconfigured %v, want %v", names, want)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdigger/log"
+	"github.com/mdigger/rest"
+)
+
+// ResetPolicy описывает ограничения на запросы сброса пароля. Все интервалы
+// задаются в секундах.
+type ResetPolicy struct {
+	MaxPerAddress int `json:"maxPerAddress"` // запросов для одного адреса за окно
+	MaxPerIP      int `json:"maxPerIP"`      // запросов с одного IP за окно
+	Window        int `json:"window"`        // окно подсчета запросов
+	Cooldown      int `json:"cooldown"`      // интервал между письмами пользователю
+	Difficulty    int `json:"difficulty"`    // сложность задачи в битах, 0 — без задачи
+}
+
+// DefaultResetPolicy задает ограничения, используемые по умолчанию.
+var DefaultResetPolicy = ResetPolicy{
+	MaxPerAddress: 5,
+	MaxPerIP:      20,
+	Window:        3600,
+	Cooldown:      60,
+}
+
+// ChallengePeriod задает время, в течение которого должна быть решена задача
+// для запроса сброса пароля.
+var ChallengePeriod = time.Minute * 5
+
+// errResetChallenge возвращается, если задача для запроса сброса пароля не
+// решена или решена неверно.
+var errResetChallenge = errors.New("bad reset challenge")
+
+// errResetLimit возвращается, если превышено количество запросов сброса
+// пароля.
+var errResetLimit = errors.New("too many reset requests")
+
+// resetCounter описывает количество запросов сброса пароля за окно.
+type resetCounter struct {
+	count int       // количество запросов
+	start time.Time // время начала окна
+}
+
+// resetRequests содержит ограничения и счетчики запросов сброса пароля для
+// адресов и IP, а также использованные задачи.
+var resetRequests = struct {
+	policy    ResetPolicy
+	addresses map[string]*resetCounter
+	ips       map[string]*resetCounter
+	solved    map[string]time.Time
+	mu        sync.Mutex
+}{
+	policy:    DefaultResetPolicy,
+	addresses: make(map[string]*resetCounter),
+	ips:       make(map[string]*resetCounter),
+	solved:    make(map[string]time.Time),
+}
+
+// resetPolicy возвращает текущие ограничения на запросы сброса пароля.
+func resetPolicy() ResetPolicy {
+	resetRequests.mu.Lock()
+	defer resetRequests.mu.Unlock()
+	return resetRequests.policy
+}
+
+// allowReset регистрирует запрос сброса пароля для адреса с указанного IP и
+// возвращает время ожидания, если количество запросов превышено. Запросы
+// учитываются независимо от того, существует ли пользователь.
+func allowReset(email, ip string) time.Duration {
+	resetRequests.mu.Lock()
+	defer resetRequests.mu.Unlock()
+	var now = time.Now()
+	var policy = resetRequests.policy
+	var window = seconds(policy.Window)
+	// удаляем устаревшие счетчики и использованные задачи
+	for _, list := range []map[string]*resetCounter{
+		resetRequests.addresses, resetRequests.ips} {
+		for key, counter := range list {
+			if now.Sub(counter.start) >= window {
+				delete(list, key)
+			}
+		}
+	}
+	for key, expires := range resetRequests.solved {
+		if now.After(expires) {
+			delete(resetRequests.solved, key)
+		}
+	}
+	var wait time.Duration
+	for _, limit := range []struct {
+		list map[string]*resetCounter
+		key  string
+		max  int
+	}{
+		{resetRequests.addresses, strings.ToLower(email), policy.MaxPerAddress},
+		{resetRequests.ips, ip, policy.MaxPerIP},
+	} {
+		var counter = limit.list[limit.key]
+		if counter == nil {
+			counter = &resetCounter{start: now}
+			limit.list[limit.key] = counter
+		}
+		if limit.max > 0 && counter.count >= limit.max {
+			if w := counter.start.Add(window).Sub(now); w > wait {
+				wait = w
+			}
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+	resetRequests.addresses[strings.ToLower(email)].count++
+	resetRequests.ips[ip].count++
+	return 0
+}
+
+// signChallenge возвращает подпись содержимого задачи.
+func signChallenge(payload string) string {
+	var mac = hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte("reset:" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newChallenge возвращает новую подписанную задачу для запроса сброса
+// пароля и время окончания ее действия.
+func newChallenge() (string, time.Time, error) {
+	random, err := randomString(16)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	var expires = time.Now().Add(ChallengePeriod).UTC()
+	var payload = strconv.FormatInt(expires.Unix(), 10) + "." + random
+	return payload + "." + signChallenge(payload), expires, nil
+}
+
+// challengeZeros возвращает количество нулевых бит в начале хеша SHA-256
+// строки "challenge:nonce".
+func challengeZeros(challenge, nonce string) int {
+	var hash = sha256.Sum256([]byte(challenge + ":" + nonce))
+	var zeros int
+	for _, b := range hash {
+		zeros += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return zeros
+}
+
+// checkChallenge проверяет решение задачи: хеш SHA-256 строки
+// "challenge:nonce" должен начинаться с указанного количества нулевых бит.
+// Каждая задача может быть использована только один раз.
+func checkChallenge(challenge, nonce string, difficulty int) bool {
+	var i = strings.LastIndexByte(challenge, '.')
+	if i < 0 || nonce == "" || len(sessionKey) == 0 ||
+		!hmac.Equal([]byte(challenge[i+1:]), []byte(signChallenge(challenge[:i]))) {
+		return false
+	}
+	unix, err := strconv.ParseInt(strings.SplitN(challenge, ".", 2)[0], 10, 64)
+	if err != nil {
+		return false
+	}
+	var expires = time.Unix(unix, 0)
+	if time.Now().After(expires) {
+		return false
+	}
+	if challengeZeros(challenge, nonce) < difficulty {
+		return false
+	}
+	resetRequests.mu.Lock()
+	defer resetRequests.mu.Unlock()
+	if _, ok := resetRequests.solved[challenge]; ok {
+		return false
+	}
+	resetRequests.solved[challenge] = expires
+	return true
+}
+
+// requestReset проверяет ограничения на запросы сброса пароля и в фоне
+// отправляет пользователю токен для сброса. Ответ не зависит от того,
+// существует ли пользователь и было ли ему отправлено письмо, а ошибки
+// отправки только записываются в лог.
+func (s *Store) requestReset(c *rest.Context, email, challenge, nonce string) error {
+	var policy = resetPolicy()
+	if policy.Difficulty > 0 && !checkChallenge(challenge, nonce, policy.Difficulty) {
+		return errResetChallenge
+	}
+	var ip = clientIP(c.Request)
+	if wait := allowReset(email, ip); wait > 0 {
+		auditLog.Warn("password reset limited", "user", email, "ip", ip)
+		c.SetHeader("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+		return errResetLimit
+	}
+	go func() {
+		switch err := s.passwordToken(email, seconds(policy.Cooldown)); err {
+		case nil, rest.ErrNotFound:
+		default:
+			log.Warn("password reset error", "user", email, "error", err)
+		}
+	}()
+	return nil
+}
+
+// ResetChallenge отдает задачу, которую необходимо решить перед запросом
+// сброса пароля. Если задача не требуется, то отдается нулевая сложность.
+func (s *Store) ResetChallenge(c *rest.Context) error {
+	var difficulty = resetPolicy().Difficulty
+	if difficulty == 0 {
+		return c.Write(rest.JSON{"difficulty": 0})
+	}
+	challenge, expires, err := newChallenge()
+	if err != nil {
+		return err
+	}
+	return c.Write(rest.JSON{
+		"challenge":  challenge,
+		"difficulty": difficulty,
+		"expires":    expires,
+	})
+}
+
+// LoadResetPolicy загружает из хранилища ограничения на запросы сброса
+// пароля, если они были заданы.
+func (s *Store) LoadResetPolicy() error {
+	var policy = DefaultResetPolicy
+	switch err := s.load(sectionConfig, "reset", &policy); err {
+	case nil:
+		resetRequests.mu.Lock()
+		resetRequests.policy = policy
+		resetRequests.mu.Unlock()
+	case rest.ErrNotFound:
+	default:
+		return err
+	}
+	return nil
+}
+
+// GetResetPolicy отдает текущие ограничения на запросы сброса пароля.
+func (s *Store) GetResetPolicy(c *rest.Context) error {
+	return c.Write(resetPolicy())
+}
+
+// SetResetPolicy задает новые ограничения на запросы сброса пароля. Не
+// указанные в запросе значения остаются без изменения.
+func (s *Store) SetResetPolicy(c *rest.Context) error {
+	var policy = resetPolicy()
+	if err := c.Bind(&policy); err != nil {
+		return c.Error(http.StatusBadRequest, err.Error())
+	}
+	if policy.MaxPerAddress < 0 || policy.MaxPerIP < 0 || policy.Window < 0 ||
+		policy.Cooldown < 0 || policy.Difficulty < 0 || policy.Difficulty > 32 {
+		return c.Error(http.StatusBadRequest, "bad reset policy")
+	}
+	if err := s.save(sectionConfig, "reset", policy); err != nil {
+		return err
+	}
+	resetRequests.mu.Lock()
+	resetRequests.policy = policy
+	resetRequests.mu.Unlock()
+	return nil
+}
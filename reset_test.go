@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// solveChallenge подбирает решение задачи с указанной сложностью и
+// возвращает его вместе с решением, которое этой сложности не соответствует.
+func solveChallenge(challenge string, difficulty int) (string, string) {
+	var valid, invalid string
+	for i := 0; valid == "" || invalid == ""; i++ {
+		var nonce = strconv.Itoa(i)
+		if challengeZeros(challenge, nonce) >= difficulty {
+			if valid == "" {
+				valid = nonce
+			}
+		} else if invalid == "" {
+			invalid = nonce
+		}
+	}
+	return valid, invalid
+}
+
+func TestCheckChallenge(t *testing.T) {
+	var key = sessionKey
+	sessionKey = []byte("test session key")
+	defer func() { sessionKey = key }()
+	const difficulty = 8
+	challenge, _, err := newChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce, weak := solveChallenge(challenge, difficulty)
+	if checkChallenge(challenge, weak, difficulty) {
+		t.Error("insufficient zero bits accepted")
+	}
+	var tampered = []byte(challenge)
+	tampered[len(tampered)-1] ^= 1
+	if checkChallenge(string(tampered), nonce, difficulty) {
+		t.Error("tampered signature accepted")
+	}
+	var payload = strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10) + ".random"
+	var expired = payload + "." + signChallenge(payload)
+	if nonce, _ := solveChallenge(expired, difficulty); checkChallenge(expired, nonce, difficulty) {
+		t.Error("expired challenge accepted")
+	}
+	if !checkChallenge(challenge, nonce, difficulty) {
+		t.Fatal("valid nonce rejected")
+	}
+	if checkChallenge(challenge, nonce, difficulty) {
+		t.Error("challenge replayed")
+	}
+}
+
+func TestAllowReset(t *testing.T) {
+	resetRequests.mu.Lock()
+	var policy = resetRequests.policy
+	resetRequests.policy = ResetPolicy{MaxPerAddress: 2, MaxPerIP: 3, Window: 3600}
+	resetRequests.addresses = make(map[string]*resetCounter)
+	resetRequests.ips = make(map[string]*resetCounter)
+	resetRequests.mu.Unlock()
+	defer func() {
+		resetRequests.mu.Lock()
+		resetRequests.policy = policy
+		resetRequests.mu.Unlock()
+	}()
+	for i := 0; i < 2; i++ {
+		if wait := allowReset("User@test.com", "10.0.0.1"); wait != 0 {
+			t.Fatalf("request %d limited", i)
+		}
+	}
+	// адрес сравнивается без учета регистра
+	if wait := allowReset("user@test.com", "10.0.0.2"); wait <= 0 || wait > time.Hour {
+		t.Fatalf("address limit: wait %v", wait)
+	}
+	if wait := allowReset("other@test.com", "10.0.0.1"); wait != 0 {
+		t.Fatal("other address limited")
+	}
+	if wait := allowReset("third@test.com", "10.0.0.1"); wait <= 0 {
+		t.Fatal("ip limit not reached")
+	}
+	// по окончании окна счетчики сбрасываются
+	resetRequests.mu.Lock()
+	for _, list := range []map[string]*resetCounter{
+		resetRequests.addresses, resetRequests.ips} {
+		for _, counter := range list {
+			counter.start = counter.start.Add(-time.Hour)
+		}
+	}
+	resetRequests.mu.Unlock()
+	if wait := allowReset("user@test.com", "10.0.0.1"); wait != 0 {
+		t.Fatalf("limit not reset: wait %v", wait)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/mdigger/rest"
+)
+
+// Role описывает права администратора: для каждого раздела API задается
+// список разрешенных методов. Раздел или метод `*` означает любой раздел
+// или метод соответственно.
+type Role map[string][]string
+
+// Allowed возвращает true, если роль разрешает указанный метод для раздела.
+func (r Role) Allowed(section, method string) bool {
+	for _, name := range []string{section, "*"} {
+		for _, m := range r[name] {
+			if m == "*" || m == method {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Предопределенные роли администраторов.
+const (
+	roleSuperAdmin     = "superadmin"
+	roleReadOnly       = "read-only"
+	roleUserManager    = "user-manager"
+	roleTemplateEditor = "template-editor"
+)
+
+// DefaultRoles содержит описание предопределенных ролей администраторов.
+var DefaultRoles = map[string]Role{
+	roleSuperAdmin: {"*": {"*"}},
+	roleReadOnly: {
+		"services":  {"GET"},
+		"groups":    {"GET"},
+		"platforms": {"GET"},
+		"users":     {"GET"},
+		"templates": {"GET"},
+		"pages":     {"GET"},
+	},
+	roleUserManager: {
+		"services":  {"GET"},
+		"groups":    {"GET"},
+		"platforms": {"GET"},
+		"users":     {"*"},
+		"disable":   {"POST"},
+		"enable":    {"POST"},
+		"templates": {"GET", "POST"},
+		"lockouts":  {"*"},
+	},
+	roleTemplateEditor: {
+		"templates": {"GET", "PUT", "DELETE"},
+		"pages":     {"GET", "PUT", "DELETE"},
+	},
+}
+
+// adminRoles содержит текущее описание ролей администраторов.
+var adminRoles = struct {
+	list map[string]Role
+	mu   sync.RWMutex
+}{list: DefaultRoles}
+
+// publicSections содержит список разделов, доступных любому авторизованному
+// администратору независимо от его ролей.
+var publicSections = map[string]bool{"login": true, "logout": true}
+
+// roleExists возвращает true, если роль с указанным именем определена.
+func roleExists(name string) bool {
+	adminRoles.mu.RLock()
+	defer adminRoles.mu.RUnlock()
+	_, ok := adminRoles.list[name]
+	return ok
+}
+
+// apiPath возвращает название раздела API и разобранный путь запроса. Путь
+// разбирается в исходном виде и каждая его часть декодируется один раз, как и
+// параметры обработчика.
+func apiPath(r *http.Request) (string, []string) {
+	var parts = strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/")
+	for i, part := range parts {
+		if name, err := url.PathUnescape(part); err == nil {
+			parts[i] = name
+		}
+	}
+	return parts[0], parts
+}
+
+// Allowed возвращает true, если роли администратора разрешают указанный метод
+// для раздела API. Администратор, для которого роли никогда не задавались,
+// считается суперадминистратором; явно заданный пустой список ролей дает
+// доступ только к общим разделам.
+func (a *Admin) Allowed(section, method string) bool {
+	if a.Roles == nil || publicSections[section] {
+		return true
+	}
+	adminRoles.mu.RLock()
+	defer adminRoles.mu.RUnlock()
+	for _, name := range a.Roles {
+		if adminRoles.list[name].Allowed(section, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// Scoped возвращает true, если доступ администратора ограничен группами или
+// Azure AD.
+func (a *Admin) Scoped() bool {
+	return a != nil && (len(a.Groups) > 0 || len(a.Tenants) > 0)
+}
+
+// InScope возвращает true, если пользователь относится к группам или Azure AD,
+// которыми ограничен доступ администратора. Если ограничения не заданы, то
+// доступны все пользователи.
+func (a *Admin) InScope(user *User) bool {
+	if !a.Scoped() {
+		return true
+	}
+	for _, group := range a.Groups {
+		if user.Group == group {
+			return true
+		}
+	}
+	for _, tenant := range a.Tenants {
+		if user.Tenant != "" && user.Tenant == tenant {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAccess проверяет права администратора на выполнение запроса. Для
+// запросов, относящихся к конкретному пользователю, проверяется, что он
+// находится в области видимости администратора.
+func (s *Store) checkAccess(c *rest.Context, admin *Admin) error {
+	var section, parts = apiPath(c.Request)
+	if !admin.Allowed(section, c.Request.Method) {
+		return c.Error(http.StatusForbidden, "admin access denied")
+	}
+	var name string // идентификатор пользователя из запроса
+	switch {
+	case section == sectionUsers && len(parts) > 1:
+		name = parts[1]
+	case section == sectionTemplates && len(parts) == 4 && parts[2] == "send":
+		name = parts[3]
+	default:
+		return nil
+	}
+	user, err := s.User(name)
+	if err == rest.ErrNotFound {
+		return nil // новый пользователь проверяется при сохранении
+	}
+	if err != nil {
+		return err
+	}
+	if !admin.InScope(user) {
+		return c.Error(http.StatusForbidden, "user out of admin scope")
+	}
+	return nil
+}
+
+// LoadRoles загружает из хранилища описание ролей администраторов. Роли из
+// хранилища дополняют или заменяют предопределенные роли.
+func (s *Store) LoadRoles() error {
+	var roles = make(map[string]Role)
+	switch err := s.load(sectionConfig, "roles", &roles); err {
+	case nil:
+		setRoles(roles)
+	case rest.ErrNotFound:
+	default:
+		return err
+	}
+	return nil
+}
+
+// setRoles объединяет предопределенные роли с указанными и устанавливает их
+// в качестве текущих.
+func setRoles(roles map[string]Role) {
+	var list = make(map[string]Role, len(DefaultRoles)+len(roles))
+	for name, role := range DefaultRoles {
+		list[name] = role
+	}
+	for name, role := range roles {
+		if role == nil {
+			delete(list, name)
+		} else {
+			list[name] = role
+		}
+	}
+	adminRoles.mu.Lock()
+	adminRoles.list = list
+	adminRoles.mu.Unlock()
+}
+
+// GetRoles отдает описание ролей администраторов.
+func (s *Store) GetRoles(c *rest.Context) error {
+	adminRoles.mu.RLock()
+	defer adminRoles.mu.RUnlock()
+	return c.Write(adminRoles.list)
+}
+
+// SetRoles задает описание дополнительных ролей администраторов или
+// переопределяет предопределенные. Роль со значением null удаляется.
+func (s *Store) SetRoles(c *rest.Context) error {
+	var roles = make(map[string]Role)
+	if err := c.Bind(&roles); err != nil {
+		return c.Error(http.StatusBadRequest, err.Error())
+	}
+	if _, ok := roles[roleSuperAdmin]; ok {
+		return c.Error(http.StatusBadRequest, "superadmin role is read-only")
+	}
+	if err := s.save(sectionConfig, "roles", roles); err != nil {
+		return err
+	}
+	setRoles(roles)
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAllowed(t *testing.T) {
+	var decode = func(data string) *Admin {
+		admin, err := decodeAdmin("admin", []byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return admin
+	}
+	for _, test := range []struct {
+		name    string
+		admin   *Admin
+		section string
+		method  string
+		allowed bool
+	}{
+		{"legacy hash", decode("$2a$10$hash"), "backup", "GET", true},
+		{"no roles field", decode(`{"password": "x"}`), "backup", "GET", true},
+		{"null roles", decode(`{"password": "x", "roles": null}`), "backup", "GET", true},
+		{"empty roles", decode(`{"password": "x", "roles": []}`), "backup", "GET", false},
+		{"empty roles login", decode(`{"password": "x", "roles": []}`), "login", "POST", true},
+		{"read-only", decode(`{"roles": ["read-only"]}`), "users", "GET", true},
+		{"read-only put", decode(`{"roles": ["read-only"]}`), "users", "PUT", false},
+		{"superadmin", decode(`{"roles": ["superadmin"]}`), "backup", "GET", true},
+	} {
+		if allowed := test.admin.Allowed(test.section, test.method); allowed != test.allowed {
+			t.Errorf("%s: allowed %v, want %v", test.name, allowed, test.allowed)
+		}
+	}
+}
+
+func TestAdminEmptyRolesStored(t *testing.T) {
+	// пустой список ролей должен сохраняться, чтобы не превратиться в
+	// отсутствие ролей и полный доступ
+	data, err := json.Marshal(&Admin{Password: "x", Roles: []string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, err := decodeAdmin("admin", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if admin.Roles == nil || admin.Allowed("backup", "GET") {
+		t.Fatalf("empty roles lost: %s", data)
+	}
+}
+
+func TestAPIPath(t *testing.T) {
+	for _, test := range []struct {
+		target string
+		name   string
+	}{
+		{"/users/user@test.com", "user@test.com"},
+		{"/users/user%40test.com", "user@test.com"},
+		// закодированный символ % не декодируется повторно
+		{"/users/user%2540test.com", "user%40test.com"},
+		{"/users/a%2Fb", "a/b"},
+	} {
+		section, parts := apiPath(httptest.NewRequest("GET", test.target, nil))
+		if section != sectionUsers || len(parts) != 2 || parts[1] != test.name {
+			t.Errorf("%s: %q %q", test.target, section, parts)
+		}
+	}
+}
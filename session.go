@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mdigger/rest"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Префиксы токенов, выдаваемых пользователям сервисом, по которым они
+// отличаются от токенов внешних провайдеров.
+const (
+	accessTokenPrefix  = "at."
+	refreshTokenPrefix = "rt."
+)
+
+// Время действия токенов пользователей.
+var (
+	AccessTokenPeriod  = time.Minute * 15
+	RefreshTokenPeriod = time.Hour * 24 * 30
+)
+
+// sessionKey содержит ключ для подписи токенов доступа пользователей.
+var sessionKey []byte
+
+// accessToken описывает содержимое токена доступа пользователя.
+type accessToken struct {
+	User    string    `json:"sub"` // идентификатор пользователя
+	Issued  time.Time `json:"iat"` // время выдачи
+	Expires time.Time `json:"exp"` // время окончания действия
+}
+
+// RefreshToken описывает сохраненный токен для обновления токена доступа.
+// Сам токен не сохраняется — хранится только его хеш.
+type RefreshToken struct {
+	User    string    `json:"user"`    // идентификатор пользователя
+	Hash    string    `json:"hash"`    // хеш секретной части
+	Created time.Time `json:"created"` // время создания
+	Expires time.Time `json:"expires"` // время окончания действия
+}
+
+// LoadSessionKey загружает из хранилища ключ для подписи токенов доступа
+// пользователей. Если ключ не задан, то он создается.
+func (s *Store) LoadSessionKey() error {
+	var config = new(struct {
+		Key []byte `json:"key"`
+	})
+	switch err := s.load(sectionConfig, "session", config); err {
+	case nil:
+		sessionKey = config.Key
+		return nil
+	case rest.ErrNotFound:
+	default:
+		return err
+	}
+	config.Key = make([]byte, 32)
+	if _, err := rand.Read(config.Key); err != nil {
+		return err
+	}
+	if err := s.save(sectionConfig, "session", config); err != nil {
+		return err
+	}
+	sessionKey = config.Key
+	return nil
+}
+
+// signAccessToken возвращает подпись содержимого токена доступа.
+func signAccessToken(payload string) string {
+	var mac = hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newAccessToken возвращает новый подписанный токен доступа пользователя.
+func newAccessToken(email string, now time.Time) (string, time.Time, error) {
+	var token = &accessToken{
+		User:    email,
+		Issued:  now.UTC(),
+		Expires: now.Add(AccessTokenPeriod).UTC(),
+	}
+	data, err := json.Marshal(token)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	var payload = base64.RawURLEncoding.EncodeToString(data)
+	return accessTokenPrefix + payload + "." + signAccessToken(payload),
+		token.Expires, nil
+}
+
+// checkAccessToken проверяет подпись и время действия токена доступа и
+// возвращает его содержимое.
+func checkAccessToken(token string) (*accessToken, error) {
+	var parts = strings.Split(strings.TrimPrefix(token, accessTokenPrefix), ".")
+	if len(parts) != 2 || len(sessionKey) == 0 ||
+		!hmac.Equal([]byte(parts[1]), []byte(signAccessToken(parts[0]))) {
+		return nil, rest.NewError(http.StatusForbidden, "bad access token")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, rest.NewError(http.StatusForbidden, "bad access token")
+	}
+	var info = new(accessToken)
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, rest.NewError(http.StatusForbidden, "bad access token")
+	}
+	if time.Now().After(info.Expires) {
+		return nil, rest.NewError(http.StatusForbidden, "access token expired")
+	}
+	return info, nil
+}
+
+// Revoked возвращает true, если токены, выданные в указанное время, отозваны.
+func (u *User) Revoked(issued time.Time) bool {
+	return u.TokensRevoked != nil && issued.Before(*u.TokensRevoked)
+}
+
+// RevokeTokens отзывает все выданные пользователю токены доступа. Токены
+// обновления удаляются отдельно с помощью removeRefreshTokens.
+func (u *User) RevokeTokens() {
+	var now = time.Now().UTC()
+	u.TokensRevoked = &now
+}
+
+// removeRefreshTokens удаляет все токены обновления пользователя.
+func removeRefreshTokens(tx *bolt.Tx, email string) error {
+	var bucket = tx.Bucket([]byte(sectionSessions))
+	if bucket == nil {
+		return nil
+	}
+	var ids [][]byte
+	if err := bucket.ForEach(func(k, v []byte) error {
+		var token = new(RefreshToken)
+		if err := json.Unmarshal(v, token); err != nil {
+			return err
+		}
+		if token.User == email {
+			ids = append(ids, k)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := bucket.Delete(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serviceToken возвращает true, если для авторизации пользователя
+// используется токен доступа или ключ устройства, выданные сервисом, или
+// клиентский сертификат, а не его учетные данные.
+func serviceToken(c *rest.Context) bool {
+	var auth = c.Header("Authorization")
+	switch {
+	case strings.HasPrefix(auth, "Bearer "+accessTokenPrefix),
+		strings.HasPrefix(auth, "Bearer "+deviceTokenPrefix):
+		return true
+	case strings.HasPrefix(auth, "Bearer "), strings.HasPrefix(auth, "Basic "):
+		return false
+	default: // авторизация по клиентскому сертификату
+		return c.Request.TLS != nil && len(c.Request.TLS.PeerCertificates) > 0
+	}
+}
+
+// issueTokens создает новые токены доступа и обновления для пользователя и
+// отдает их.
+func (s *Store) issueTokens(c *rest.Context, user *User) error {
+	var now = time.Now()
+	access, expires, err := newAccessToken(user.Email, now)
+	if err != nil {
+		return err
+	}
+	var data = make([]byte, 40)
+	if _, err := rand.Read(data); err != nil {
+		return err
+	}
+	var id = hex.EncodeToString(data[:8])
+	var secret = base64.RawURLEncoding.EncodeToString(data[8:])
+	var refresh = &RefreshToken{
+		User:    user.Email,
+		Hash:    hashAPIKey(secret),
+		Created: now.UTC(),
+		Expires: now.Add(RefreshTokenPeriod).UTC(),
+	}
+	if err := s.save(sectionSessions, id, refresh); err != nil {
+		return err
+	}
+	return c.Write(rest.JSON{
+		"token":          access,
+		"type":           "Bearer",
+		"expires":        expires,
+		"refresh":        refreshTokenPrefix + id + "." + secret,
+		"refreshExpires": refresh.Expires,
+	})
+}
+
+// UserLogin проверяет авторизацию пользователя с помощью HTTP Basic или токена
+// внешнего провайдера и отдает токен доступа и токен для его обновления.
+func (s *Store) UserLogin(c *rest.Context) error {
+	// токен доступа не может использоваться для получения новых токенов
+	if serviceToken(c) {
+		return c.Error(http.StatusForbidden, "user credentials required")
+	}
+	user, err := s.AuthUser(c)
+	if err != nil {
+		return err
+	}
+	return s.issueTokens(c, user)
+}
+
+// UserRefresh заменяет токен обновления на новый и отдает новый токен доступа.
+// Каждый токен обновления может быть использован только один раз.
+func (s *Store) UserRefresh(c *rest.Context) error {
+	var params = new(struct {
+		Token string `json:"refresh"`
+	})
+	if err := c.Bind(params); err != nil {
+		return c.Error(http.StatusBadRequest, err.Error())
+	}
+	var parts = strings.SplitN(strings.TrimPrefix(params.Token, refreshTokenPrefix), ".", 2)
+	if len(parts) != 2 {
+		return c.Error(http.StatusForbidden, "bad refresh token")
+	}
+	var token = new(RefreshToken)
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		var bucket = tx.Bucket([]byte(sectionSessions))
+		if bucket == nil {
+			return c.Error(http.StatusForbidden, "bad refresh token")
+		}
+		var data = bucket.Get([]byte(parts[0]))
+		if data == nil {
+			return c.Error(http.StatusForbidden, "bad refresh token")
+		}
+		if err := json.Unmarshal(data, token); err != nil {
+			return err
+		}
+		if subtle.ConstantTimeCompare([]byte(token.Hash),
+			[]byte(hashAPIKey(parts[1]))) != 1 {
+			return c.Error(http.StatusForbidden, "bad refresh token")
+		}
+		// токен обновления одноразовый
+		return bucket.Delete([]byte(parts[0]))
+	}); err != nil {
+		return err
+	}
+	if time.Now().After(token.Expires) {
+		return c.Error(http.StatusForbidden, "refresh token expired")
+	}
+	c.AddLogField("user", token.User)
+	user, err := s.User(token.User)
+	if err == rest.ErrNotFound {
+		return rest.ErrForbidden
+	}
+	if err != nil {
+		return err
+	}
+	if user.Revoked(token.Created) {
+		return c.Error(http.StatusForbidden, "refresh token revoked")
+	}
+	if err := user.Check(); err != nil {
+		return err
+	}
+	return s.issueTokens(c, user)
+}
+
+// PurgeRefreshTokens удаляет токены обновления, время действия которых
+// истекло.
+func (s *Store) PurgeRefreshTokens() error {
+	var now = time.Now()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		var bucket = tx.Bucket([]byte(sectionSessions))
+		if bucket == nil {
+			return nil
+		}
+		var ids [][]byte
+		if err := bucket.ForEach(func(k, v []byte) error {
+			var token = new(RefreshToken)
+			if err := json.Unmarshal(v, token); err != nil {
+				return err
+			}
+			if now.After(token.Expires) {
+				ids = append(ids, k)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err := bucket.Delete(id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
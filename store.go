@@ -1,9 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"io/ioutil"
 	"net/http"
 	"strings"
 	"time"
@@ -14,7 +16,8 @@ import (
 
 // Store описывает хранилище с информацией.
 type Store struct {
-	db *bolt.DB // хранилище данных
+	db      *bolt.DB // хранилище данных
+	Archive bool     // сохранять данные удаленных пользователей в архиве
 }
 
 // OpenStore открывает хранилище данных.
@@ -41,20 +44,59 @@ const (
 	sectionConfig    = "config"
 	sectionTemplates = "templates"
 	sectionReset     = "reset"
+	sectionArchive   = "archive"
+	sectionKeys      = "keys"
+	sectionJWKS      = "jwks"
+	sectionSessions  = "sessions"
+	sectionEnroll    = "enroll"
+	sectionDevices   = "devices"
+	sectionPlatforms = "platforms"
+	sectionCAs       = "cas"
+	sectionCerts     = "certs"
+	sectionPages     = "pages"
 )
 
+// userSections содержит список разделов хранилища, в которых в качестве
+// ключа используется идентификатор пользователя. Эти данные удаляются или
+// переносятся вместе с пользователем.
+var userSections = []string{sectionUserData}
+
+// ownedSections содержит разделы хранилища, в которых ключом служит токен или
+// случайный идентификатор, а сама запись ссылается на владельца: поле field
+// содержит идентификатор пользователя или администратора из раздела owners.
+var ownedSections = map[string]struct{ field, owners string }{
+	sectionReset:    {"user", sectionUsers},
+	sectionSessions: {"user", sectionUsers},
+	sectionEnroll:   {"user", sectionUsers},
+	sectionDevices:  {"user", sectionUsers},
+	sectionCerts:    {"user", sectionUsers},
+	sectionKeys:     {"admin", sectionAdmins},
+}
+
 // List отдает JSON со списком ключей в указанном разделе хранилища.
 // Возвращает rest.ErrNotFound, если раздел в хранилище не найден.
 func (s *Store) List(section string) rest.Handler {
 	return func(c *rest.Context) error {
 		var list []string
+		// список пользователей ограничивается областью видимости администратора
+		var admin = currentAdmin(c)
+		var scoped = section == sectionUsers && admin.Scoped()
 		if err := s.db.View(func(tx *bolt.Tx) error {
 			var bucket = tx.Bucket([]byte(section))
 			if bucket == nil {
 				return c.Error(http.StatusNotFound, "section not found")
 			}
 			list = make([]string, 0, bucket.Stats().KeyN)
-			return bucket.ForEach(func(k, _ []byte) error {
+			return bucket.ForEach(func(k, v []byte) error {
+				if scoped {
+					var user = new(User)
+					if err := json.Unmarshal(v, user); err != nil {
+						return err
+					}
+					if !admin.InScope(user) {
+						return nil
+					}
+				}
 				list = append(list, string(k))
 				return nil
 			})
@@ -86,10 +128,6 @@ func (s *Store) Item(section string) rest.Handler {
 			if len(data) > 1 && data[0] == '{' {
 				return c.Write(json.RawMessage(data))
 			}
-			// для административного раздела отдаем пароли в виде JSON
-			if section == sectionAdmins {
-				return c.Write(rest.JSON{"password": string(data)})
-			}
 			// иначе — как строку
 			return c.Write(data)
 		})
@@ -115,6 +153,18 @@ func (s *Store) Remove(section string) rest.Handler {
 	}
 }
 
+// bindOptional разбирает тело запроса в формате JSON, если оно не пустое.
+func bindOptional(c *rest.Context, obj interface{}) error {
+	data, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, obj)
+}
+
 // save сохраняет данные в указанном разделе хранилища с указанным именем
 func (s *Store) save(section, name string, obj interface{}) error {
 	var data []byte
@@ -147,6 +197,22 @@ func (s *Store) save(section, name string, obj interface{}) error {
 	})
 }
 
+// load загружает и разбирает JSON с именованными данными из указанного
+// раздела хранилища. Если данные не найдены, то возвращает rest.ErrNotFound.
+func (s *Store) load(section, name string, obj interface{}) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		var bucket = tx.Bucket([]byte(section))
+		if bucket == nil {
+			return rest.ErrNotFound
+		}
+		var data = bucket.Get([]byte(name))
+		if data == nil {
+			return rest.ErrNotFound
+		}
+		return json.Unmarshal(data, obj)
+	})
+}
+
 // Update обновляет именованные данные в указанном разделе. В зависимости от
 // раздела, поддерживается разная обработка входящих данных в запросе.
 func (s *Store) Update(section string) rest.Handler {
@@ -173,22 +239,79 @@ func (s *Store) Update(section string) rest.Handler {
 			if user.Group == "" {
 				return c.Error(http.StatusBadRequest, "user group required")
 			}
-			if user.Tenant == "" && user.Password == "" {
+			if !currentAdmin(c).InScope(user) {
+				return c.Error(http.StatusForbidden, "user out of admin scope")
+			}
+			if user.TokenProvider() == "" && user.Password == "" {
 				return c.Error(http.StatusBadRequest, "user password required")
 			}
+			if user.Password != "" {
+				if err := checkPassword(user.Password, name); err != nil {
+					return passwordError(c, err)
+				}
+			}
+			// при изменении пароля отзываем выданные пользователю токены
+			switch old, err := s.User(name); err {
+			case nil:
+				user.TokensRevoked = old.TokensRevoked
+				if old.Password != user.Password {
+					user.RevokeTokens()
+					if err := s.db.Update(func(tx *bolt.Tx) error {
+						return removeRefreshTokens(tx, name)
+					}); err != nil {
+						return err
+					}
+				}
+			case rest.ErrNotFound:
+			default:
+				return err
+			}
 			user.Updated = time.Now().UTC()
 			obj = user
-		case sectionAdmins: // пароли администратора
+		case sectionAdmins: // администратор
+			// не указанные в запросе списки остаются без изменения
 			var data = new(struct {
 				Password `json:"password"`
+				Roles    *[]string `json:"roles"`
+				Groups   *[]string `json:"groups"`
+				Tenants  *[]string `json:"tenants"`
 			})
 			if err := c.Bind(data); err != nil {
 				return c.Error(http.StatusBadRequest, err.Error())
 			}
-			if data.Password == "" {
+			// сохраняем остальные настройки администратора
+			admin, err := s.Admin(name)
+			if err == rest.ErrNotFound {
+				admin = &Admin{Name: name}
+			} else if err != nil {
+				return err
+			}
+			if data.Password == "" && admin.Password == "" {
 				return c.Error(http.StatusBadRequest, "password required")
 			}
-			obj = data.Password
+			if data.Password != "" {
+				if err := checkPassword(data.Password, name); err != nil {
+					return passwordError(c, err)
+				}
+				admin.Password = data.Password
+			}
+			if data.Roles != nil {
+				for _, role := range *data.Roles {
+					if !roleExists(role) {
+						return c.Error(http.StatusBadRequest, fmt.Sprintf(
+							"unknown admin role %s", role))
+					}
+				}
+				admin.Roles = *data.Roles
+			}
+			if data.Groups != nil {
+				admin.Groups = *data.Groups
+			}
+			if data.Tenants != nil {
+				admin.Tenants = *data.Tenants
+			}
+			removeAdminSessions(name)
+			obj = admin
 		case sectionTemplates: // почтовый шаблон
 			var data = new(MailTemplate)
 			if err := c.Bind(data); err != nil {
@@ -205,35 +328,20 @@ func (s *Store) Update(section string) rest.Handler {
 	}
 }
 
-// AdminAuth проверяет авторизацию администратора сервиса, если она задана.
-func (s *Store) AdminAuth(c *rest.Context) error {
-	username, password, ok := c.BasicAuth()
-	return s.db.View(func(tx *bolt.Tx) error {
-		var bucket = tx.Bucket([]byte(sectionAdmins))
-		// если раздел не задан или в нем нет ни одной записи,
-		// то авторизация не требуется
-		if bucket == nil || bucket.Stats().KeyN == 0 {
-			return nil
-		}
-		if !ok {
-			var realm = fmt.Sprintf("Basic realm=%s admin", appName)
-			c.SetHeader("WWW-Authenticate", realm)
-			return rest.ErrUnauthorized
-		}
-		c.AddLogField("admin", username) // добавляем в лог имя администратора
-		var data = bucket.Get([]byte(username))
-		if data == nil {
-			return c.Error(http.StatusForbidden, "bad admin name")
-		}
-		if !(Password(data).Compare(password)) {
-			return c.Error(http.StatusForbidden, "bad admin password")
-		}
-		return nil
-	})
+// backupSecrets содержит поля настроек, которые не включаются в резервную
+// копию: закрытый ключ встроенного удостоверяющего центра, пароль сервера
+// SMTP, секретный ключ клиента OpenID Connect и ключ подписи токенов доступа
+// и проверочных заданий.
+var backupSecrets = map[string][]string{
+	"ca":      {"key"},
+	"mail":    {"password"},
+	"oidc":    {"secret"},
+	"session": {"key"},
 }
 
-// Backup отдает представление хранилища в виде одного большого JSON пакета.
-func (s *Store) Backup(c *rest.Context) error {
+// backup возвращает представление хранилища в виде одного большого JSON
+// пакета без секретных полей настроек.
+func (s *Store) backup() (rest.JSON, error) {
 	var result = make(rest.JSON) // результирующий JSON
 	if err := s.db.View(func(tx *bolt.Tx) error {
 		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
@@ -253,10 +361,37 @@ func (s *Store) Backup(c *rest.Context) error {
 			}); err != nil {
 				return err
 			}
+			if string(name) == sectionConfig {
+				for key, fields := range backupSecrets {
+					data, ok := section[key].(json.RawMessage)
+					if !ok {
+						continue
+					}
+					var value = make(map[string]json.RawMessage)
+					if err := json.Unmarshal(data, &value); err != nil {
+						return err
+					}
+					for _, field := range fields {
+						delete(value, field)
+					}
+					section[key] = value
+				}
+			}
 			result[string(name)] = section
 			return nil
 		})
 	}); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Backup отдает представление хранилища в виде одного большого JSON пакета.
+// Секретные поля настроек, перечисленные в backupSecrets, в него не
+// включаются.
+func (s *Store) Backup(c *rest.Context) error {
+	result, err := s.backup()
+	if err != nil {
 		return err
 	}
 	return c.Write(result)
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+)
+
+// testStore открывает временное хранилище, которое закрывается по окончании
+// теста.
+func testStore(t *testing.T) *Store {
+	t.Helper()
+	store, err := OpenStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestBackupSecrets(t *testing.T) {
+	var store = testStore(t)
+	if err := store.save(sectionConfig, "ca", &CAConfig{
+		Certificate: "certificate",
+		Key:         "secret",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.save(sectionConfig, "mail", &MailConfig{
+		Transport: transportSMTP,
+		Host:      "smtp.test.com",
+		Password:  "secret",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.save(sectionConfig, "oidc", &OIDCConfig{
+		Issuer: "https://login.test.com",
+		Secret: "secret",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.LoadSessionKey(); err != nil {
+		t.Fatal(err)
+	}
+	result, err := store.backup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var backup = new(struct {
+		Config map[string]map[string]interface{} `json:"config"`
+	})
+	if err := json.Unmarshal(data, backup); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := backup.Config["ca"]["key"]; ok || backup.Config["ca"]["certificate"] != "certificate" {
+		t.Errorf("bad ca backup %v", backup.Config["ca"])
+	}
+	if _, ok := backup.Config["mail"]["password"]; ok || backup.Config["mail"]["host"] != "smtp.test.com" {
+		t.Errorf("bad mail backup %v", backup.Config["mail"])
+	}
+	if _, ok := backup.Config["oidc"]["secret"]; ok || backup.Config["oidc"]["issuer"] != "https://login.test.com" {
+		t.Errorf("bad oidc backup %v", backup.Config["oidc"])
+	}
+	if _, ok := backup.Config["session"]["key"]; ok {
+		t.Errorf("bad session backup %v", backup.Config["session"])
+	}
+}
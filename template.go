@@ -2,16 +2,16 @@ package main
 
 import (
 	"bytes"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
 	"mime"
 	"mime/quotedprintable"
+	"net/mail"
+	"time"
 
 	bolt "go.etcd.io/bbolt"
-	gmail "google.golang.org/api/gmail/v1"
 )
 
 // MailTemplate описывает шаблон для формирования почтового сообщения.
@@ -22,33 +22,55 @@ type MailTemplate struct {
 	template *template.Template
 }
 
-// Send отсылает почтовое уведомление на указанный адрес с использованием
-// шаблона.
-func (mt *MailTemplate) Send(client *gmail.Service,
-	to string, data interface{}) error {
+// Message формирует почтовое сообщение для указанного адреса с
+// использованием шаблона. Если адрес отправителя не задан, то заголовок
+// From не добавляется и его подставляет почтовый сервис. Адреса
+// разбираются и записываются в заголовки заново, поэтому не могут добавить
+// в сообщение собственные заголовки.
+func (mt *MailTemplate) Message(from, to string, data interface{}) ([]byte, error) {
+	toAddr, err := mail.ParseAddress(to)
+	if err != nil {
+		return nil, fmt.Errorf("bad email address %q: %s", to, err)
+	}
 	var buf = new(bytes.Buffer)
 	fmt.Fprintf(buf, "MIME-Version: %s\r\n", "1.0")
-	fmt.Fprintf(buf, "To: %s\r\n", to)
+	fmt.Fprintf(buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	if from != "" {
+		fromAddr, err := mail.ParseAddress(from)
+		if err != nil {
+			return nil, fmt.Errorf("bad from address %q: %s", from, err)
+		}
+		fmt.Fprintf(buf, "From: %s\r\n", fromAddr)
+	}
+	fmt.Fprintf(buf, "To: %s\r\n", toAddr)
 	if mt.Subject != "" {
 		fmt.Fprintf(buf, "Subject: %s\r\n",
 			mime.QEncoding.Encode("utf-8", mt.Subject))
 	}
 	buf.WriteString("Content-Type: ")
 	if mt.HTML {
-		buf.WriteString("text/html\r\n")
+		buf.WriteString("text/html; charset=utf-8\r\n")
 	} else {
-		buf.WriteString("text/plain\r\n")
+		buf.WriteString("text/plain; charset=utf-8\r\n")
 	}
 	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
 	var enc = quotedprintable.NewWriter(buf)
 	if err := mt.template.Execute(enc, data); err != nil {
-		return err
+		return nil, err
 	}
 	enc.Close()
-	_, err := client.Users.Messages.Send("me", &gmail.Message{
-		Raw: base64.RawURLEncoding.EncodeToString(buf.Bytes()),
-	}).Do()
-	return err
+	return buf.Bytes(), nil
+}
+
+// Send отсылает почтовое уведомление на указанный адрес с использованием
+// шаблона.
+func (mt *MailTemplate) Send(mailer Mailer, from, to string,
+	data interface{}) error {
+	message, err := mt.Message(from, to, data)
+	if err != nil {
+		return err
+	}
+	return mailer.Send(to, message)
 }
 
 // Template возвращает шаблон с указанным именем из хранилища.
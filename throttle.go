@@ -0,0 +1,309 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mdigger/log"
+	"github.com/mdigger/rest"
+)
+
+var (
+	auditLog     = log.New("audit")
+	authAttempts = NewThrottle()
+)
+
+// Ограничения на объем хранимой информации о неудачных попытках, чтобы
+// перебор случайных имен пользователей не расходовал память и время.
+var (
+	throttleMax           = 10000       // максимальное количество записей
+	throttlePurgeInterval = time.Minute // интервал удаления устаревших записей
+)
+
+// LockoutPolicy описывает ограничения на неудачные попытки авторизации.
+// Все интервалы задаются в секундах.
+type LockoutPolicy struct {
+	MaxAttempts   int `json:"maxAttempts"`   // попыток для пользователя до блокировки
+	MaxIPAttempts int `json:"maxIPAttempts"` // попыток с одного адреса до блокировки
+	Delay         int `json:"delay"`         // начальная задержка после ошибки
+	MaxDelay      int `json:"maxDelay"`      // максимальная задержка
+	Lockout       int `json:"lockout"`       // время блокировки
+	Window        int `json:"window"`        // время хранения информации об ошибках
+}
+
+// DefaultLockoutPolicy задает ограничения, используемые по умолчанию.
+var DefaultLockoutPolicy = LockoutPolicy{
+	MaxAttempts:   10,
+	MaxIPAttempts: 50,
+	Delay:         1,
+	MaxDelay:      60,
+	Lockout:       900,
+	Window:        3600,
+}
+
+// seconds возвращает интервал в секундах в виде time.Duration.
+func seconds(n int) time.Duration {
+	return time.Duration(n) * time.Second
+}
+
+// Attempts описывает информацию о неудачных попытках авторизации.
+type Attempts struct {
+	Failures int       `json:"failures"`         // количество ошибок
+	Last     time.Time `json:"last"`             // время последней ошибки
+	Until    time.Time `json:"until"`            // время, до которого запрещен доступ
+	Locked   bool      `json:"locked,omitempty"` // флаг блокировки
+}
+
+// Throttle отслеживает неудачные попытки авторизации пользователей и с
+// отдельных адресов, увеличивая задержку между попытками и временно
+// блокируя доступ при превышении лимита.
+type Throttle struct {
+	policy LockoutPolicy
+	users  map[string]*Attempts
+	ips    map[string]*Attempts
+	purged time.Time // время последнего удаления устаревших записей
+	mu     sync.Mutex
+}
+
+// NewThrottle возвращает новый инициализированный Throttle с ограничениями
+// по умолчанию.
+func NewThrottle() *Throttle {
+	return &Throttle{
+		policy: DefaultLockoutPolicy,
+		users:  make(map[string]*Attempts),
+		ips:    make(map[string]*Attempts),
+	}
+}
+
+// Policy возвращает текущие ограничения.
+func (t *Throttle) Policy() LockoutPolicy {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.policy
+}
+
+// SetPolicy заменяет ограничения на новые.
+func (t *Throttle) SetPolicy(policy LockoutPolicy) {
+	t.mu.Lock()
+	t.policy = policy
+	t.mu.Unlock()
+}
+
+// Wait возвращает время, которое осталось до разрешения следующей попытки
+// авторизации пользователя с указанного адреса.
+func (t *Throttle) Wait(username, ip string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var now, wait = time.Now(), time.Duration(0)
+	for _, a := range []*Attempts{t.users[username], t.ips[ip]} {
+		if a != nil && a.Until.After(now) && a.Until.Sub(now) > wait {
+			wait = a.Until.Sub(now)
+		}
+	}
+	return wait
+}
+
+// Fail регистрирует неудачную попытку авторизации.
+func (t *Throttle) Fail(username, ip string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var now = time.Now()
+	if now.Sub(t.purged) >= throttlePurgeInterval {
+		t.purge(now)
+	}
+	// без имени пользователя учитываются только попытки с адреса
+	if username != "" && t.fail(t.users, username, t.policy.MaxAttempts, now) {
+		auditLog.Warn("user locked", "user", username, "ip", ip,
+			"until", t.users[username].Until)
+	}
+	if t.fail(t.ips, ip, t.policy.MaxIPAttempts, now) {
+		auditLog.Warn("address locked", "ip", ip, "user", username,
+			"until", t.ips[ip].Until)
+	}
+}
+
+// fail увеличивает счетчик ошибок и вычисляет время следующей разрешенной
+// попытки. Возвращает true, если при этом произошла блокировка.
+func (t *Throttle) fail(list map[string]*Attempts, key string, max int,
+	now time.Time) bool {
+	var a = list[key]
+	if a == nil {
+		if len(list) >= throttleMax {
+			evict(list, now)
+		}
+		a = new(Attempts)
+		list[key] = a
+	}
+	// после окончания блокировки счетчик ошибок начинается заново
+	if a.Locked && now.After(a.Until) {
+		a.Failures, a.Locked = 0, false
+	}
+	a.Failures++
+	a.Last = now
+	if max > 0 && a.Failures >= max {
+		a.Until = now.Add(seconds(t.policy.Lockout))
+		var locked = !a.Locked
+		a.Locked = true
+		return locked
+	}
+	// задержка удваивается после каждой неудачной попытки
+	var delay = seconds(t.policy.Delay)
+	for i := 1; i < a.Failures && delay < seconds(t.policy.MaxDelay); i++ {
+		delay *= 2
+	}
+	if delay > seconds(t.policy.MaxDelay) {
+		delay = seconds(t.policy.MaxDelay)
+	}
+	a.Until = now.Add(delay)
+	return false
+}
+
+// purge удаляет устаревшую информацию о неудачных попытках.
+func (t *Throttle) purge(now time.Time) {
+	var window = seconds(t.policy.Window)
+	for _, list := range []map[string]*Attempts{t.users, t.ips} {
+		for key, a := range list {
+			if now.Sub(a.Last) > window && now.After(a.Until) {
+				delete(list, key)
+			}
+		}
+	}
+	t.purged = now
+}
+
+// evict освобождает место для новых записей, удаляя десятую часть списка.
+// В первую очередь удаляются записи без действующей блокировки, а среди
+// них — дольше всех не обновлявшиеся, поэтому перебор случайных имен не
+// вытесняет действующие блокировки.
+func evict(list map[string]*Attempts, now time.Time) {
+	var keys = make([]string, 0, len(list))
+	for key := range list {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		var a, b = list[keys[i]], list[keys[j]]
+		var locked = a.Locked && a.Until.After(now)
+		if locked != (b.Locked && b.Until.After(now)) {
+			return !locked
+		}
+		return a.Last.Before(b.Last)
+	})
+	for _, key := range keys[:len(keys)/10+1] {
+		delete(list, key)
+	}
+}
+
+// Reset сбрасывает информацию о неудачных попытках пользователя после
+// успешной авторизации. Информация о попытках с адреса не сбрасывается,
+// чтобы ее нельзя было обнулить авторизацией под своим пользователем.
+func (t *Throttle) Reset(username string) {
+	t.mu.Lock()
+	delete(t.users, username)
+	t.mu.Unlock()
+}
+
+// Clear удаляет информацию о неудачных попытках и блокировку пользователя
+// или адреса с указанным именем. Возвращает false, если такой информации
+// не найдено.
+func (t *Throttle) Clear(name string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, user := t.users[name]
+	_, ip := t.ips[name]
+	delete(t.users, name)
+	delete(t.ips, name)
+	return user || ip
+}
+
+// List возвращает копию информации о неудачных попытках авторизации.
+func (t *Throttle) List() (users, ips map[string]Attempts) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	users = make(map[string]Attempts, len(t.users))
+	for key, a := range t.users {
+		users[key] = *a
+	}
+	ips = make(map[string]Attempts, len(t.ips))
+	for key, a := range t.ips {
+		ips[key] = *a
+	}
+	return users, ips
+}
+
+// clientIP возвращает IP-адрес клиента, с которого пришел запрос.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// tooManyRequests возвращает ошибку о превышении количества попыток и
+// устанавливает заголовок с временем ожидания.
+func tooManyRequests(c *rest.Context, wait time.Duration) error {
+	var retry = int((wait + time.Second - 1) / time.Second)
+	c.SetHeader("Retry-After", strconv.Itoa(retry))
+	return c.Error(http.StatusTooManyRequests, "too many failed attempts")
+}
+
+// LoadLockoutPolicy загружает из хранилища ограничения на неудачные попытки
+// авторизации, если они были заданы.
+func (s *Store) LoadLockoutPolicy() error {
+	var policy = DefaultLockoutPolicy
+	switch err := s.load(sectionConfig, "lockout", &policy); err {
+	case nil:
+		authAttempts.SetPolicy(policy)
+	case rest.ErrNotFound:
+	default:
+		return err
+	}
+	return nil
+}
+
+// GetLockoutPolicy отдает текущие ограничения на неудачные попытки
+// авторизации.
+func (s *Store) GetLockoutPolicy(c *rest.Context) error {
+	return c.Write(authAttempts.Policy())
+}
+
+// SetLockoutPolicy задает новые ограничения на неудачные попытки
+// авторизации. Не указанные в запросе значения остаются без изменения.
+func (s *Store) SetLockoutPolicy(c *rest.Context) error {
+	var policy = authAttempts.Policy()
+	if err := c.Bind(&policy); err != nil {
+		return c.Error(http.StatusBadRequest, err.Error())
+	}
+	if policy.Delay < 0 || policy.MaxDelay < policy.Delay ||
+		policy.Lockout < 0 || policy.Window < 0 ||
+		policy.MaxAttempts < 0 || policy.MaxIPAttempts < 0 {
+		return c.Error(http.StatusBadRequest, "bad lockout policy")
+	}
+	if err := s.save(sectionConfig, "lockout", policy); err != nil {
+		return err
+	}
+	authAttempts.SetPolicy(policy)
+	return nil
+}
+
+// Lockouts отдает информацию о неудачных попытках авторизации и
+// заблокированных пользователях и адресах.
+func (s *Store) Lockouts(c *rest.Context) error {
+	users, ips := authAttempts.List()
+	return c.Write(rest.JSON{"users": users, "ips": ips})
+}
+
+// ClearLockout снимает блокировку с пользователя или адреса, указанного в
+// запросе.
+func (s *Store) ClearLockout(c *rest.Context) error {
+	var name = c.Param("name")
+	if !authAttempts.Clear(name) {
+		return c.Error(http.StatusNotFound, "lockout not found")
+	}
+	auditLog.Info("lockout cleared", "name", name)
+	return nil
+}
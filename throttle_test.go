@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestThrottleLimit(t *testing.T) {
+	var max = throttleMax
+	throttleMax = 100
+	defer func() { throttleMax = max }()
+	var throttle = NewThrottle()
+	for i := 0; i < DefaultLockoutPolicy.MaxAttempts; i++ {
+		throttle.Fail("victim@test.com", "10.0.0.1")
+	}
+	// перебор случайных имен не увеличивает список сверх ограничения и не
+	// вытесняет действующую блокировку
+	for i := 0; i < 1000; i++ {
+		throttle.Fail("user"+strconv.Itoa(i)+"@test.com", "10.0.1."+strconv.Itoa(i%250))
+	}
+	users, ips := throttle.List()
+	if len(users) > throttleMax || len(ips) > throttleMax {
+		t.Fatalf("%d users and %d addresses stored", len(users), len(ips))
+	}
+	if !users["victim@test.com"].Locked || throttle.Wait("victim@test.com", "") == 0 {
+		t.Fatal("lockout evicted")
+	}
+}
+
+func TestThrottlePurge(t *testing.T) {
+	var throttle = NewThrottle()
+	throttle.Fail("old@test.com", "10.0.0.1")
+	var expire = func() {
+		throttle.mu.Lock()
+		var past = time.Now().Add(-seconds(throttle.policy.Window) - time.Hour)
+		throttle.users["old@test.com"].Last = past
+		throttle.users["old@test.com"].Until = past
+		throttle.mu.Unlock()
+	}
+	expire()
+	// устаревшие записи удаляются не чаще throttlePurgeInterval
+	throttle.Fail("", "10.0.0.2")
+	if users, _ := throttle.List(); len(users) != 1 {
+		t.Fatal("purged before interval")
+	}
+	throttle.mu.Lock()
+	throttle.purged = time.Now().Add(-throttlePurgeInterval)
+	throttle.mu.Unlock()
+	throttle.Fail("", "10.0.0.2")
+	if users, _ := throttle.List(); len(users) != 0 {
+		t.Fatalf("stale entries not purged: %v", users)
+	}
+}
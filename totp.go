@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Параметры одноразовых кодов TOTP (RFC 6238).
+const (
+	totpPeriod = 30 // период действия кода в секундах
+	totpDigits = 6  // количество цифр в коде
+	totpSkew   = 1  // допустимое расхождение времени в периодах
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewTOTPSecret возвращает новый случайный секретный ключ для генерации
+// одноразовых кодов в кодировке base32.
+func NewTOTPSecret() (string, error) {
+	var secret = make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// TOTPURI возвращает otpauth URI для добавления ключа в приложение
+// аутентификатора.
+func TOTPURI(account, secret string) string {
+	var params = url.Values{
+		"secret":    {secret},
+		"issuer":    {appName},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	return fmt.Sprintf("otpauth://totp/%s:%s?%s",
+		url.PathEscape(appName), url.PathEscape(account), params.Encode())
+}
+
+// totpCode возвращает одноразовый код для указанного счетчика.
+func totpCode(key []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	var mac = hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	var sum = mac.Sum(nil)
+	var offset = sum[len(sum)-1] & 0x0f
+	var value = binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// totpUsed хранит последний использованный счетчик для каждого ключа, чтобы
+// один и тот же код нельзя было использовать повторно.
+var totpUsed = struct {
+	counters map[string]uint64
+	mu       sync.Mutex
+}{counters: make(map[string]uint64)}
+
+// VerifyTOTP возвращает true, если одноразовый код соответствует секретному
+// ключу в текущий момент времени. Повторно использовать код нельзя.
+func VerifyTOTP(secret, code string) bool {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return false
+	}
+	var now = uint64(time.Now().Unix() / totpPeriod)
+	totpUsed.mu.Lock()
+	defer totpUsed.mu.Unlock()
+	for i := -totpSkew; i <= totpSkew; i++ {
+		var counter = now + uint64(i)
+		if !hmac.Equal([]byte(totpCode(key, counter)), []byte(code)) {
+			continue
+		}
+		if counter <= totpUsed.counters[secret] {
+			return false // код уже использовался
+		}
+		totpUsed.counters[secret] = counter
+		return true
+	}
+	return false
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"encoding/base64"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -16,13 +16,47 @@ import (
 
 // User описывает структуру данных пользователя.
 type User struct {
-	Email    string               `json:"-"`     // email адрес
-	Group    string               `json:"group"` // название группы
-	Tenant   string               `json:"tenant,omitempty"`
+	Email    string               `json:"-"`                  // email адрес
+	Group    string               `json:"group"`              // название группы
+	Tenant   string               `json:"tenant,omitempty"`   // идентификатор организации
+	Provider string               `json:"provider,omitempty"` // провайдер токенов
 	Password Password             `json:"password,omitempty"` // хеш пароля пользователя
 	Name     string               `json:"name,omitempty"`     // имя пользователя
 	Services map[string]rest.JSON `json:"services,omitempty"` // параметры сервисов
 	Updated  time.Time            `json:"updated"`            // время обновления
+	Disabled bool                 `json:"disabled,omitempty"` // доступ запрещен
+	// время, до которого доступ пользователя заблокирован
+	LockedUntil *time.Time `json:"lockedUntil,omitempty"`
+	// время окончания действия учетной записи
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// время, до которого выданные пользователю токены считаются отозванными
+	TokensRevoked *time.Time `json:"revoked,omitempty"`
+}
+
+// TokenProvider возвращает название провайдера токенов, к которому привязан
+// пользователь. Для совместимости пользователи с заданным идентификатором
+// Azure AD без указания провайдера привязаны к Azure.
+func (u *User) TokenProvider() string {
+	if u.Provider == "" && u.Tenant != "" {
+		return providerAzure
+	}
+	return u.Provider
+}
+
+// Check возвращает ошибку, если учетная запись пользователя отключена,
+// временно заблокирована или срок ее действия истек.
+func (u *User) Check() error {
+	var now = time.Now()
+	switch {
+	case u.Disabled:
+		return rest.NewError(http.StatusForbidden, "user disabled")
+	case u.LockedUntil != nil && now.Before(*u.LockedUntil):
+		return rest.NewError(http.StatusForbidden, fmt.Sprintf(
+			"user locked until %s", u.LockedUntil.UTC().Format(time.RFC3339)))
+	case u.ExpiresAt != nil && !now.Before(*u.ExpiresAt):
+		return rest.NewError(http.StatusForbidden, "user account expired")
+	}
+	return nil
 }
 
 // User возвращает информацию о пользователе с указанным идентификатором.
@@ -46,14 +80,97 @@ func (s *Store) User(username string) (*User, error) {
 	return user, nil
 }
 
+// updateUser изменяет сохраненную информацию о пользователе с помощью функции
+// update. Чтение и сохранение выполняются в одной транзакции, поэтому
+// изменения, сделанные другими запросами, не теряются.
+func (s *Store) updateUser(username string, update func(*User) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		var bucket = tx.Bucket([]byte(sectionUsers))
+		if bucket == nil {
+			return rest.ErrNotFound
+		}
+		var data = bucket.Get([]byte(username))
+		if data == nil {
+			return rest.ErrNotFound
+		}
+		var user = new(User)
+		if err := json.Unmarshal(data, user); err != nil {
+			return err
+		}
+		user.Email = username
+		if err := update(user); err != nil {
+			return err
+		}
+		data, err := json.MarshalIndent(user, "", "    ")
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(username), data)
+	})
+}
+
 // AuthUser возвращает информацию об авторизованном пользователе.
 func (s *Store) AuthUser(c *rest.Context) (*User, error) {
 	// запрашивает токен авторизации из заголовка
 	switch auth := c.Header("Authorization"); {
+	case strings.HasPrefix(auth, "Bearer "+deviceTokenPrefix):
+		// ключ устройства, подключенного по одноразовому коду
+		device, err := s.Device(strings.TrimPrefix(auth, "Bearer "))
+		if err != nil {
+			return nil, err
+		}
+		c.AddLogField("user", device.User) // добавляем в лог имя пользователя
+		c.AddLogField("device", device.ID)
+		user, err := s.User(device.User)
+		if err == rest.ErrNotFound {
+			return nil, rest.ErrForbidden
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := user.Check(); err != nil {
+			return nil, err
+		}
+		if err := s.touchDevice(c, device); err != nil {
+			return nil, err
+		}
+		c.Request = c.Request.WithContext(
+			context.WithValue(c.Request.Context(), deviceKey{}, device))
+		return user, nil
+	case strings.HasPrefix(auth, "Bearer "+accessTokenPrefix):
+		// токен доступа, выданный сервисом
+		token, err := checkAccessToken(strings.TrimPrefix(auth, "Bearer "))
+		if err != nil {
+			return nil, err
+		}
+		c.AddLogField("user", token.User) // добавляем в лог имя пользователя
+		user, err := s.User(token.User)
+		if err == rest.ErrNotFound {
+			return nil, rest.ErrForbidden
+		}
+		if err != nil {
+			return nil, err
+		}
+		if user.Revoked(token.Issued) {
+			return nil, rest.NewError(http.StatusForbidden, "access token revoked")
+		}
+		if err := user.Check(); err != nil {
+			return nil, err
+		}
+		return user, nil
 	case strings.HasPrefix(auth, "Bearer "):
 		var token = strings.TrimPrefix(auth, "Bearer ") // авторизационный токен
+		// определяем провайдера, выдавшего токен
+		providerName, provider, issuerTenant, err := findProvider(token)
+		if err != nil {
+			return nil, rest.NewError(http.StatusForbidden, err.Error())
+		}
+		keys, err := provider.Auth()
+		if err != nil {
+			return nil, rest.NewError(http.StatusServiceUnavailable, err.Error())
+		}
 		// необходимо проверить новый токен на валидность
-		claim, err := jwt.Verify(token, authKeys.GetKey)
+		claim, err := jwt.Verify(token, keys.GetKey)
 		if err != nil {
 			// отдельно подменяем ошибку получения списка ключей
 			if err, ok := err.(*url.Error); ok {
@@ -63,43 +180,51 @@ func (s *Store) AuthUser(c *rest.Context) (*User, error) {
 			return nil, rest.NewError(http.StatusForbidden, err.Error())
 		}
 		// токен проверен — распаковываем содержимое
-		var info = new(struct {
-			ID     string `json:"upn"`
-			Tenant string `json:"tid"`
-		})
-		if err = json.Unmarshal(claim, &info); err != nil {
+		var claims = make(map[string]interface{})
+		if err = json.Unmarshal(claim, &claims); err != nil {
 			return nil, err
 		}
-		c.AddLogField("user", info.ID) // добавляем в лог имя пользователя
+		var id = claimString(claims, provider.UserClaim)
+		if id == "" {
+			return nil, rest.NewError(http.StatusForbidden, "token user id required")
+		}
+		c.AddLogField("user", id) // добавляем в лог имя пользователя
 		// подгружаем информацию о пользователе по его идентификатору
-		user, err := s.User(info.ID)
+		user, err := s.User(id)
 		if err == rest.ErrNotFound {
 			return nil, rest.ErrForbidden
 		}
 		if err != nil {
 			return nil, err
 		}
-		if user.Tenant == "" || user.Tenant != info.Tenant {
-			return nil, rest.NewError(http.StatusForbidden, "bad user azure tenant")
+		// проверяем, что пользователь привязан к этому провайдеру
+		if user.TokenProvider() != providerName {
+			return nil, rest.NewError(http.StatusForbidden, "bad user token provider")
 		}
-		return user, nil
-	case strings.HasPrefix(auth, "Basic "):
-		username, password, ok := c.BasicAuth()
-		if !ok {
-			return nil, rest.ErrForbidden
+		var tenant = claimString(claims, provider.TenantClaim)
+		if provider.TenantClaim != "" && (user.Tenant == "" || user.Tenant != tenant) {
+			return nil, rest.NewError(http.StatusForbidden, "bad user tenant")
 		}
-		c.AddLogField("user", username) // добавляем в лог имя пользователя
-		user, err := s.User(username)
-		if err == rest.ErrNotFound {
-			return nil, rest.ErrForbidden
+		// организация в iss должна совпадать с организацией пользователя
+		if issuerTenant != "" && issuerTenant != user.Tenant {
+			return nil, rest.NewError(http.StatusForbidden, "bad token issuer")
 		}
-		if err != nil {
+		if err := provider.Validate(claims, user.Tenant); err != nil {
+			return nil, rest.NewError(http.StatusForbidden, err.Error())
+		}
+		if err := user.Check(); err != nil {
 			return nil, err
 		}
-		if user.Password == "" || !user.Password.Compare(password) {
+		return user, nil
+	case strings.HasPrefix(auth, "Basic "):
+		username, password, ok := c.BasicAuth()
+		if !ok {
 			return nil, rest.ErrForbidden
 		}
-		return user, nil
+		return s.passwordUser(c, username, password)
+	case c.Request.TLS != nil && len(c.Request.TLS.PeerCertificates) > 0:
+		// авторизация с помощью клиентского сертификата
+		return s.certUser(c)
 	default:
 		var realm = fmt.Sprintf("Basic realm=%s", appName)
 		c.SetHeader("WWW-Authenticate", realm)
@@ -107,10 +232,49 @@ func (s *Store) AuthUser(c *rest.Context) (*User, error) {
 	}
 }
 
+// passwordUser проверяет имя и пароль пользователя с учетом ограничений на
+// количество неудачных попыток и возвращает информацию о нем.
+func (s *Store) passwordUser(c *rest.Context, username, password string) (*User, error) {
+	c.AddLogField("user", username) // добавляем в лог имя пользователя
+	// проверяем ограничения на количество неудачных попыток
+	var ip = clientIP(c.Request)
+	if wait := authAttempts.Wait(username, ip); wait > 0 {
+		return nil, tooManyRequests(c, wait)
+	}
+	user, err := s.User(username)
+	if err == rest.ErrNotFound {
+		authAttempts.Fail(username, ip)
+		return nil, rest.ErrForbidden
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.Password == "" || !user.Password.Compare(password) {
+		authAttempts.Fail(username, ip)
+		return nil, rest.ErrForbidden
+	}
+	authAttempts.Reset(username)
+	if err := user.Check(); err != nil {
+		return nil, err
+	}
+	// пересчитываем хеш пароля с текущими параметрами
+	if user.Password.NeedsRehash() {
+		if err := s.rehashPassword(sectionUsers, user.Email, user.Password,
+			password); err != nil {
+			return nil, err
+		}
+	}
+	return user, nil
+}
+
 // config возвращает объединенный конфигурационный файл для указанного
-// пользователя.
-func (s *Store) config(user *User) (interface{}, error) {
-	var result interface{} = user.Services
+// пользователя. Поверх параметров пользователя применяются параметры,
+// заданные для платформы и устройства, если они указаны. Если создан
+// встроенный удостоверяющий центр, то в раздел certificate добавляется его
+// сертификат и действующий сертификат пользователя.
+func (s *Store) config(user *User, platform string, device *Device) (
+	map[string]rest.JSON, error) {
+	var result = user.Services
 	if err := s.db.View(func(tx *bolt.Tx) error {
 		var bucket = tx.Bucket([]byte(sectionGroups))
 		if bucket == nil {
@@ -161,9 +325,61 @@ func (s *Store) config(user *User) (interface{}, error) {
 	}); err != nil {
 		return nil, err
 	}
+	// параметры платформы
+	if platform != "" {
+		var overrides = make(map[string]rest.JSON)
+		switch err := s.load(sectionPlatforms, platform, &overrides); err {
+		case nil:
+			result = mergeServices(result, overrides)
+		case rest.ErrNotFound:
+		default:
+			return nil, err
+		}
+	}
+	// параметры устройства
+	if device != nil {
+		result = mergeServices(result, device.Services)
+	}
+	// сертификат, выпущенный встроенным удостоверяющим центром
+	cert, err := s.certConfig(user, device)
+	if err != nil {
+		return nil, err
+	}
+	if cert != nil {
+		if result == nil {
+			result = make(map[string]rest.JSON, 1)
+		}
+		result["certificate"] = cert
+	}
 	return result, nil
 }
 
+// mergeServices переопределяет параметры сервисов конфигурации. Параметры
+// со значением null удаляются.
+func mergeServices(config, overrides map[string]rest.JSON) map[string]rest.JSON {
+	if len(overrides) == 0 {
+		return config
+	}
+	if config == nil {
+		config = make(map[string]rest.JSON, len(overrides))
+	}
+	for name, params := range overrides {
+		var service = config[name]
+		if service == nil {
+			service = make(rest.JSON, len(params))
+			config[name] = service
+		}
+		for key, value := range params {
+			if value == nil {
+				delete(service, key)
+			} else {
+				service[key] = value
+			}
+		}
+	}
+	return config
+}
+
 // Config возвращает объединенный конфиг пользователя. При этом проверяется
 // авторизация пользователя и имя пользователя берется из нее.
 func (s *Store) Config(c *rest.Context) error {
@@ -171,7 +387,11 @@ func (s *Store) Config(c *rest.Context) error {
 	if err != nil {
 		return err
 	}
-	config, err := s.config(user)
+	device, platform, err := s.requestDevice(c, user)
+	if err != nil {
+		return err
+	}
+	config, err := s.config(user, platform, device)
 	if err != nil {
 		return err
 	}
@@ -179,25 +399,408 @@ func (s *Store) Config(c *rest.Context) error {
 }
 
 // UserConfig возвращает объединенный конфиг пользователя. При этом авторизация
-// пользователя не проверяется, а имя пользователя берется из запроса.
+// пользователя не проверяется, а имя пользователя берется из запроса. Для
+// получения конфигурации для платформы или устройства пользователя они
+// указываются в параметрах запроса ?platform и ?device.
 func (s *Store) UserConfig(c *rest.Context) error {
 	user, err := s.User(c.Param("name"))
 	if err != nil {
 		return err
 	}
-	config, err := s.config(user)
+	var query = c.Request.URL.Query()
+	var platform = query.Get("platform")
+	var device *Device
+	if id := query.Get("device"); id != "" {
+		device = &Device{ID: id}
+		if err := s.load(sectionDevices, id, device); err == rest.ErrNotFound ||
+			(err == nil && device.User != user.Email) {
+			return c.Error(http.StatusNotFound, "device not found")
+		} else if err != nil {
+			return err
+		}
+		if platform == "" {
+			platform = device.Platform
+		}
+	}
+	config, err := s.config(user, platform, device)
 	if err != nil {
 		return err
 	}
 	return c.Write(config)
 }
 
+// removeUser удаляет пользователя и все связанные с ним данные в рамках
+// указанной транзакции. Если задан флаг archive, то удаляемые данные
+// предварительно сохраняются в архивном разделе хранилища.
+func removeUser(tx *bolt.Tx, name string, archive bool) error {
+	var bucket = tx.Bucket([]byte(sectionUsers))
+	if bucket == nil {
+		return rest.ErrNotFound
+	}
+	var data = bucket.Get([]byte(name))
+	if data == nil {
+		return rest.ErrNotFound
+	}
+	var archived = rest.JSON{
+		sectionUsers: json.RawMessage(data),
+		"deleted":    time.Now().UTC(),
+	}
+	if err := bucket.Delete([]byte(name)); err != nil {
+		return err
+	}
+	// удаляем связанные с пользователем данные из остальных разделов
+	for _, section := range userSections {
+		var bucket = tx.Bucket([]byte(section))
+		if bucket == nil {
+			continue
+		}
+		var data = bucket.Get([]byte(name))
+		if data == nil {
+			continue
+		}
+		archived[section] = json.RawMessage(data)
+		if err := bucket.Delete([]byte(name)); err != nil {
+			return err
+		}
+	}
+	// токены сброса пароля в архиве не сохраняем
+	if err := removeResetTokens(tx, name); err != nil {
+		return err
+	}
+	if err := removeRefreshTokens(tx, name); err != nil {
+		return err
+	}
+	if err := removeEnrollments(tx, name); err != nil {
+		return err
+	}
+	if err := revokeCertificates(tx, name, ""); err != nil {
+		return err
+	}
+	if err := moveDevices(tx, name, ""); err != nil {
+		return err
+	}
+	if !archive {
+		return nil
+	}
+	// в архиве хранится только последняя удаленная копия пользователя
+	data, err := json.MarshalIndent(archived, "", "    ")
+	if err != nil {
+		return err
+	}
+	bucket, err = tx.CreateBucketIfNotExists([]byte(sectionArchive))
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(name), data)
+}
+
+// RemoveUser удаляет пользователя вместе с его дополнительными данными и
+// токенами для сброса пароля. Если для хранилища задан флаг Archive или
+// в запросе указан параметр ?archive, то данные пользователя сохраняются
+// в архиве.
+func (s *Store) RemoveUser(c *rest.Context) error {
+	var archive = s.Archive ||
+		len(c.Request.URL.Query()["archive"]) > 0
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := removeUser(tx, c.Param("name"), archive)
+		if err == rest.ErrNotFound {
+			return c.Error(http.StatusNotFound, "user not found")
+		}
+		return err
+	})
+}
+
+// renameUser переносит пользователя и все связанные с ним данные под новый
+// идентификатор в рамках указанной транзакции. Токены для сброса пароля при
+// этом удаляются.
+func renameUser(tx *bolt.Tx, from, to string) error {
+	var bucket = tx.Bucket([]byte(sectionUsers))
+	if bucket == nil {
+		return rest.ErrNotFound
+	}
+	var data = bucket.Get([]byte(from))
+	if data == nil {
+		return rest.ErrNotFound
+	}
+	if bucket.Get([]byte(to)) != nil {
+		return rest.NewError(http.StatusConflict, "user already exists")
+	}
+	if err := bucket.Put([]byte(to), data); err != nil {
+		return err
+	}
+	if err := bucket.Delete([]byte(from)); err != nil {
+		return err
+	}
+	for _, section := range userSections {
+		var bucket = tx.Bucket([]byte(section))
+		if bucket == nil {
+			continue
+		}
+		var data = bucket.Get([]byte(from))
+		if data == nil {
+			continue
+		}
+		if err := bucket.Put([]byte(to), data); err != nil {
+			return err
+		}
+		if err := bucket.Delete([]byte(from)); err != nil {
+			return err
+		}
+	}
+	// токены сброса пароля и обновления, коды подключения устройств и
+	// сертификаты выданы для старого адреса, а сами устройства переносятся
+	if err := removeResetTokens(tx, from); err != nil {
+		return err
+	}
+	if err := removeRefreshTokens(tx, from); err != nil {
+		return err
+	}
+	if err := removeEnrollments(tx, from); err != nil {
+		return err
+	}
+	if err := revokeCertificates(tx, from, ""); err != nil {
+		return err
+	}
+	return moveDevices(tx, from, to)
+}
+
+// RenameUser изменяет email пользователя, перенося все его данные под новый
+// идентификатор. Если в запросе указан флаг notify, то на старый и новый
+// адреса отправляются уведомления с использованием шаблонов
+// emailChangedFrom и emailChangedTo.
+func (s *Store) RenameUser(c *rest.Context) error {
+	var name = c.Param("name")
+	var data = new(struct {
+		Email  string `json:"email"`
+		Notify bool   `json:"notify"`
+	})
+	if err := c.Bind(data); err != nil {
+		return c.Error(http.StatusBadRequest, err.Error())
+	}
+	// проверяем, что это похоже на email
+	if !strings.ContainsRune(data.Email, '@') {
+		return c.Error(http.StatusBadRequest, "bad user email")
+	}
+	if data.Email == name {
+		return nil
+	}
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		err := renameUser(tx, name, data.Email)
+		if err == rest.ErrNotFound {
+			return c.Error(http.StatusNotFound, "user not found")
+		}
+		return err
+	}); err != nil {
+		return err
+	}
+	if !data.Notify {
+		return nil
+	}
+	user, err := s.User(data.Email)
+	if err != nil {
+		return err
+	}
+	var params = rest.JSON{"from": name, "to": data.Email}
+	if err := s.Send(user, "emailChangedTo", params); err != nil {
+		return err
+	}
+	user.Email = name // уведомление на старый адрес
+	return s.Send(user, "emailChangedFrom", params)
+}
+
+// SetUsersStatus возвращает обработчик, который отключает или включает
+// доступ для списка пользователей. Пользователи выбираются по списку email,
+// группе или идентификатору Azure AD, указанным в запросе. Возвращает список
+// измененных пользователей.
+func (s *Store) SetUsersStatus(disabled bool) rest.Handler {
+	return func(c *rest.Context) error {
+		var filter = new(struct {
+			Users  []string `json:"users"`
+			Group  string   `json:"group"`
+			Tenant string   `json:"tenant"`
+		})
+		if err := c.Bind(filter); err != nil {
+			return c.Error(http.StatusBadRequest, err.Error())
+		}
+		if len(filter.Users) == 0 && filter.Group == "" && filter.Tenant == "" {
+			return c.Error(http.StatusBadRequest, "users, group or tenant required")
+		}
+		var admin = currentAdmin(c)
+		var names = make(map[string]bool, len(filter.Users))
+		for _, name := range filter.Users {
+			names[name] = true
+		}
+		var list = make([]string, 0)
+		if err := s.db.Update(func(tx *bolt.Tx) error {
+			var bucket = tx.Bucket([]byte(sectionUsers))
+			if bucket == nil {
+				return nil
+			}
+			var updated = make(map[string][]byte)
+			if err := bucket.ForEach(func(k, v []byte) error {
+				var user = new(User)
+				if err := json.Unmarshal(v, user); err != nil {
+					return err
+				}
+				if !names[string(k)] &&
+					(filter.Group == "" || user.Group != filter.Group) &&
+					(filter.Tenant == "" || user.Tenant != filter.Tenant) {
+					return nil
+				}
+				if !admin.InScope(user) {
+					return nil
+				}
+				if user.Disabled == disabled {
+					return nil
+				}
+				user.Disabled = disabled
+				user.Updated = time.Now().UTC()
+				data, err := json.MarshalIndent(user, "", "    ")
+				if err != nil {
+					return err
+				}
+				updated[string(k)] = data
+				return nil
+			}); err != nil {
+				return err
+			}
+			// изменять раздел во время перебора его элементов нельзя
+			for name, data := range updated {
+				if err := bucket.Put([]byte(name), data); err != nil {
+					return err
+				}
+				list = append(list, name)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		return c.Write(rest.JSON{sectionUsers: list})
+	}
+}
+
+// Orphans возвращает список ключей в разделах с пользовательскими данными,
+// для которых не найдено соответствующего пользователя, а также записей с
+// токенами, ссылающихся на несуществующих пользователей или администраторов.
+// Если remove установлен, то найденные записи удаляются. Сертификаты вместо
+// удаления отзываются, чтобы они оставались в списке отозванных.
+func (s *Store) Orphans(remove bool) (map[string][]string, error) {
+	var result = make(map[string][]string)
+	var fn = s.db.View
+	if remove {
+		fn = s.db.Update
+	}
+	if err := fn(func(tx *bolt.Tx) error {
+		var users = tx.Bucket([]byte(sectionUsers))
+		for _, section := range userSections {
+			var bucket = tx.Bucket([]byte(section))
+			if bucket == nil {
+				continue
+			}
+			var keys []string
+			if err := bucket.ForEach(func(k, _ []byte) error {
+				if users == nil || users.Get(k) == nil {
+					keys = append(keys, string(k))
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			if len(keys) == 0 {
+				continue
+			}
+			result[section] = keys
+			if !remove {
+				continue
+			}
+			for _, key := range keys {
+				if err := bucket.Delete([]byte(key)); err != nil {
+					return err
+				}
+			}
+		}
+		for section, owned := range ownedSections {
+			var bucket = tx.Bucket([]byte(section))
+			if bucket == nil {
+				continue
+			}
+			var owners = tx.Bucket([]byte(owned.owners))
+			var keys []string
+			var revoke = make(map[string]bool) // владельцы отзываемых сертификатов
+			if err := bucket.ForEach(func(k, v []byte) error {
+				var record = make(map[string]interface{})
+				var err = json.Unmarshal(v, &record)
+				var owner, _ = record[owned.field].(string)
+				if err == nil && owner != "" && owners != nil &&
+					owners.Get([]byte(owner)) != nil {
+					return nil
+				}
+				if section == sectionCerts {
+					// поврежденные и уже отозванные сертификаты не изменяются
+					if err != nil || owner == "" || record["revoked"] != nil {
+						return nil
+					}
+					revoke[owner] = true
+				}
+				// записи в старом формате или без владельца тоже считаются
+				// потерянными
+				keys = append(keys, string(k))
+				return nil
+			}); err != nil {
+				return err
+			}
+			if len(keys) == 0 {
+				continue
+			}
+			result[section] = keys
+			if !remove {
+				continue
+			}
+			if section == sectionCerts {
+				for owner := range revoke {
+					if err := revokeCertificates(tx, owner, ""); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			for _, key := range keys {
+				if err := bucket.Delete([]byte(key)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Sweep отдает список данных, для которых не найдено соответствующего
+// пользователя. При запросе с методом DELETE эти данные удаляются.
+func (s *Store) Sweep(c *rest.Context) error {
+	orphans, err := s.Orphans(c.Request.Method == http.MethodDelete)
+	if err != nil {
+		return err
+	}
+	return c.Write(orphans)
+}
+
 // SetUserPassword заменяет пароль пользователя на новый
 func (s *Store) SetUserPassword(c *rest.Context) error {
+	// для смены пароля необходимо знать текущий пароль
+	if serviceToken(c) {
+		return c.Error(http.StatusForbidden, "user credentials required")
+	}
 	user, err := s.AuthUser(c)
 	if err != nil {
 		return err
 	}
+	// паролем пользователей внешних провайдеров токенов управляет провайдер
+	if user.TokenProvider() != "" {
+		return c.Error(http.StatusForbidden, "token provider user password change forbidden")
+	}
 	var data = new(struct {
 		Password string `json:"password"`
 	})
@@ -207,104 +810,280 @@ func (s *Store) SetUserPassword(c *rest.Context) error {
 	if data.Password == "" {
 		return c.Error(http.StatusBadRequest, "password required")
 	}
+	// хеш вместо пароля принимается только через административный API
+	if Password(data.Password).Hashed() {
+		return c.Error(http.StatusBadRequest, "bad password")
+	}
 	if user.Password.Compare(data.Password) {
 		return nil
 	}
+	if err := checkPassword(Password(data.Password), user.Email); err != nil {
+		return passwordError(c, err)
+	}
 	user.Password = Password(data.Password)
 	user.Updated = time.Now().UTC()
-	return s.save(sectionUsers, user.Email, user)
+	return s.revokeTokens(user)
 }
 
-// ResetData описывает данные для сброса пароля
+// revokeTokens отзывает все выданные пользователю токены и сохраняет его.
+func (s *Store) revokeTokens(user *User) error {
+	user.RevokeTokens()
+	data, err := json.MarshalIndent(user, "", "    ")
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := removeRefreshTokens(tx, user.Email); err != nil {
+			return err
+		}
+		bucket, err := tx.CreateBucketIfNotExists([]byte(sectionUsers))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(user.Email), data)
+	})
+}
+
+// ResetData описывает данные для сброса пароля. Сам токен не сохраняется —
+// в качестве ключа используется его хеш.
 type ResetData struct {
-	Code Password  `json:"code"`
-	Date time.Time `json:"created"`
+	User    string    `json:"user"`    // идентификатор пользователя
+	Created time.Time `json:"created"` // время создания
+	Expires time.Time `json:"expires"` // время окончания действия
 }
 
-// PasswordToken генерирует токен для изменения пароля пользователя.
-func (s *Store) PasswordToken(c *rest.Context) error {
-	user, err := s.User(c.Param("name"))
-	if err != nil {
+// ValidTokenPeriod определяет время действия токена для замены пароля.
+var ValidTokenPeriod = time.Hour * 24 * 5
+
+// removeResetTokens удаляет токены сброса пароля пользователя в рамках
+// транзакции. Если идентификатор пользователя не задан, то удаляются только
+// токены, время действия которых истекло.
+func removeResetTokens(tx *bolt.Tx, email string) error {
+	var bucket = tx.Bucket([]byte(sectionReset))
+	if bucket == nil {
+		return nil
+	}
+	var now = time.Now()
+	var keys [][]byte
+	if err := bucket.ForEach(func(k, v []byte) error {
+		var reset = new(ResetData)
+		// токены в старом формате не содержат времени окончания действия и
+		// тоже удаляются
+		if err := json.Unmarshal(v, reset); err != nil ||
+			reset.User == "" || reset.User == email || now.After(reset.Expires) {
+			keys = append(keys, k)
+		}
+		return nil
+	}); err != nil {
 		return err
 	}
-	if user.Tenant != "" {
-		return rest.NewError(http.StatusForbidden, "azure ad user password reset forbidden")
+	for _, key := range keys {
+		if err := bucket.Delete(key); err != nil {
+			return err
+		}
 	}
-	var reset = &ResetData{
-		Code: NewPassword(),
-		Date: time.Now().UTC(),
+	return nil
+}
+
+// PurgeResetTokens удаляет токены сброса пароля, время действия которых
+// истекло.
+func (s *Store) PurgeResetTokens() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return removeResetTokens(tx, "")
+	})
+}
+
+// PasswordToken генерирует токен для изменения пароля пользователя и
+// отправляет его пользователю по почте. Чтобы не раскрывать наличие учетной
+// записи, ответ не зависит от того, найден ли пользователь. Если требуется
+// решение задачи, то она и ее решение передаются в теле запроса.
+func (s *Store) PasswordToken(c *rest.Context) error {
+	var params = new(struct {
+		Challenge string `json:"challenge"`
+		Nonce     string `json:"nonce"`
+	})
+	if err := bindOptional(c, params); err != nil {
+		return c.Error(http.StatusBadRequest, err.Error())
 	}
-	if err := s.save(sectionReset, user.Email, reset); err != nil {
+	switch err := s.requestReset(c, c.Param("name"), params.Challenge, params.Nonce); err {
+	case errResetChallenge:
+		return c.Error(http.StatusForbidden, err.Error())
+	case errResetLimit:
+		return c.Error(http.StatusTooManyRequests, err.Error())
+	default:
 		return err
 	}
-	var token = base64.RawURLEncoding.EncodeToString(
-		[]byte(fmt.Sprintf("%s:%s", user.Email, reset.Code)))
-	return s.Send(user, "resetPassword", rest.JSON{"token": token})
 }
 
-// ValidTokenPeriod определяет время действия токена для замены пароля.
-var ValidTokenPeriod = time.Hour * 24 * 5
-
-// ResetPassword устанавливает новый пароль пользователя.
-func (s *Store) ResetPassword(c *rest.Context) error {
-	token, err := base64.RawURLEncoding.DecodeString(c.Param("token"))
+// passwordToken генерирует токен для изменения пароля пользователя. Токен
+// представляет собой случайную строку; ранее выданные пользователю токены
+// при этом становятся недействительными. Если предыдущий токен был выдан
+// менее cooldown назад, то новый токен не создается и письмо не
+// отправляется.
+func (s *Store) passwordToken(name string, cooldown time.Duration) error {
+	user, err := s.User(name)
+	if err != nil {
+		return err
+	}
+	// пароль пользователей внешних провайдеров токенов не сбрасывается
+	if user.TokenProvider() != "" {
+		return rest.NewError(http.StatusForbidden, "token provider user password reset forbidden")
+	}
+	token, err := randomString(32)
 	if err != nil {
-		return c.Error(http.StatusNotFound, "bad token")
+		return err
 	}
-	var stoken = string(token)
-	var sindex = strings.IndexByte(stoken, ':')
-	if sindex < 0 {
-		return c.Error(http.StatusNotFound, "bad token")
+	var now = time.Now()
+	data, err := json.MarshalIndent(&ResetData{
+		User:    user.Email,
+		Created: now.UTC(),
+		Expires: now.Add(ValidTokenPeriod).UTC(),
+	}, "", "    ")
+	if err != nil {
+		return err
 	}
-	var name, code = stoken[:sindex], stoken[sindex+1:]
+	var skip bool // предыдущий токен выдан слишком недавно
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(sectionReset))
+		if err != nil {
+			return err
+		}
+		if err := bucket.ForEach(func(k, v []byte) error {
+			var reset = new(ResetData)
+			if json.Unmarshal(v, reset) == nil && reset.User == user.Email &&
+				now.Sub(reset.Created) < cooldown && now.Before(reset.Expires) {
+				skip = true
+			}
+			return nil
+		}); err != nil || skip {
+			return err
+		}
+		// у пользователя может быть только один действующий токен
+		if err := removeResetTokens(tx, user.Email); err != nil {
+			return err
+		}
+		return bucket.Put([]byte(hashAPIKey(token)), data)
+	}); err != nil {
+		return err
+	}
+	if skip {
+		auditLog.Info("password reset skipped", "user", user.Email)
+		return nil
+	}
+	// ссылка на страницу для выбора нового пароля
+	var link = "/web/password/" + url.PathEscape(token)
+	if PublicURL != "" {
+		link = strings.TrimSuffix(PublicURL, "/") + link
+	}
+	return s.Send(user, "resetPassword", rest.JSON{"token": token, "link": link})
+}
+
+// resetData возвращает данные для сброса пароля по токену. Если задан флаг
+// remove, то токен удаляется как использованный. Функция check, если задана,
+// вызывается до удаления токена: при возврате ошибки токен остается
+// действительным. Токен с истекшим временем действия удаляется в любом
+// случае.
+func (s *Store) resetData(token string, remove bool,
+	check func(*ResetData) error) (*ResetData, error) {
+	var reset = new(ResetData)
+	var failure error // ошибка, при которой изменения все равно сохраняются
 	if err := s.db.Update(func(tx *bolt.Tx) error {
 		var bucket = tx.Bucket([]byte(sectionReset))
 		if bucket == nil {
-			return c.Error(http.StatusNotFound, "bad token")
+			return rest.NewError(http.StatusNotFound, "bad token")
 		}
 		// получаем данные для сброса
-		var data = bucket.Get([]byte(name))
+		var key = []byte(hashAPIKey(token))
+		var data = bucket.Get(key)
 		if data == nil {
-			return c.Error(http.StatusNotFound, "bad token")
+			return rest.NewError(http.StatusNotFound, "bad token")
 		}
-		// удаляем данные для сброса
-		if err := bucket.Delete([]byte(name)); err != nil {
-			return err
-		}
-		// декодируем данные для сброса пароля
-		var reset = new(ResetData)
-		if err := json.Unmarshal(data, reset); err != nil {
-			return err
+		// декодируем данные для сброса пароля и проверяем время жизни токена
+		if err := json.Unmarshal(data, reset); err != nil || reset.User == "" ||
+			time.Now().After(reset.Expires) {
+			failure = rest.NewError(http.StatusNotFound, "token expired")
+			return bucket.Delete(key)
 		}
-		// проверяем время жизни токена и его код
-		if !reset.Code.Compare(code) {
-			return c.Error(http.StatusNotFound, "bad token")
+		if check != nil {
+			if err := check(reset); err != nil {
+				return err
+			}
 		}
-		if reset.Date.After(time.Now().Add(ValidTokenPeriod)) {
-			return c.Error(http.StatusNotFound, "token expired")
+		if !remove {
+			return nil
 		}
-		return nil
+		// удаляем данные для сброса
+		return bucket.Delete(key)
 	}); err != nil {
+		return nil, err
+	}
+	if failure != nil {
+		return nil, failure
+	}
+	return reset, nil
+}
+
+// CheckResetToken проверяет, что токен для сброса пароля действителен, и
+// отдает время окончания его действия. Токен при этом не используется.
+func (s *Store) CheckResetToken(c *rest.Context) error {
+	reset, err := s.resetData(c.Param("token"), false, nil)
+	if err != nil {
 		return err
 	}
+	return c.Write(rest.JSON{"expires": reset.Expires})
+}
 
-	user, err := s.User(name)
+// ResetPassword устанавливает новый пароль пользователя. Если пароль передан
+// в запросе, то он проверяется на соответствие требованиям и
+// устанавливается; иначе генерируется и отдается новый случайный пароль.
+func (s *Store) ResetPassword(c *rest.Context) error {
+	var params = new(struct {
+		Password string `json:"password"`
+	})
+	// для совместимости с прежними клиентами тело запроса необязательно
+	if err := bindOptional(c, params); err != nil {
+		return c.Error(http.StatusBadRequest, err.Error())
+	}
+	var password = Password(params.Password)
+	if password.Hashed() {
+		return c.Error(http.StatusBadRequest, "bad password")
+	}
+	// пароль, не соответствующий требованиям, не приводит к использованию
+	// токена, чтобы пользователь мог попробовать другой
+	reset, err := s.resetData(c.Param("token"), true, func(reset *ResetData) error {
+		if password == "" {
+			return nil
+		}
+		return checkPassword(password, reset.User)
+	})
+	if err != nil {
+		return passwordError(c, err)
+	}
+
+	user, err := s.User(reset.User)
 	if err != nil {
 		return c.Error(http.StatusNotFound, "bad user token")
 	}
-	user.Password = NewPassword()
+	var generated = password == ""
+	if generated {
+		password = NewPassword()
+	}
+	user.Password = password
 	user.Updated = time.Now().UTC()
 	// если в запросе есть параметр email, то отправить почту
-	if len(c.Request.URL.Query()["email"]) > 0 {
+	if generated && len(c.Request.URL.Query()["email"]) > 0 {
 		if err := s.Send(user, "newPassword",
 			rest.JSON{"password": user.Password}); err != nil {
 			return err
 		}
 	}
-	if err := s.save(sectionUsers, name, user); err != nil {
+	if err := s.revokeTokens(user); err != nil {
 		return err
 	}
-	return c.Write(rest.JSON{"password": string(user.Password)})
+	if !generated {
+		return nil
+	}
+	return c.Write(rest.JSON{"password": string(password)})
 }
 
 // UserDataPatch обновляет дополнительную пользовательскую информацию.
@@ -313,21 +1092,35 @@ func (s *Store) UserDataPatch(c *rest.Context) error {
 	if err := c.Bind(&patchData); err != nil {
 		return err
 	}
-	var name = c.Param("name")
-	var userData = make(rest.JSON)
-	if err := s.db.View(func(tx *bolt.Tx) error {
-		var bucket = tx.Bucket([]byte(sectionUserData))
-		if bucket == nil {
-			return nil
+	return s.patchUserData(c.Param("name"), patchData)
+}
+
+// updateUserData изменяет дополнительные данные пользователя с помощью
+// функции update. Чтение и сохранение выполняются в одной транзакции.
+func (s *Store) updateUserData(name string, update func(userData rest.JSON)) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(sectionUserData))
+		if err != nil {
+			return err
 		}
-		var data = bucket.Get([]byte(name))
-		if data == nil {
-			return nil
+		var userData = make(rest.JSON)
+		if data := bucket.Get([]byte(name)); data != nil {
+			if err := json.Unmarshal(data, &userData); err != nil {
+				return err
+			}
 		}
-		return json.Unmarshal(data, &userData)
-	}); err != nil {
-		return err
-	}
+		update(userData)
+		data, err := json.MarshalIndent(userData, "", "    ")
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(name), data)
+	})
+}
+
+// mergeUserData объединяет дополнительные данные пользователя с переданными.
+// Ключи со значением null удаляются.
+func mergeUserData(userData, patchData rest.JSON) {
 	for k, v := range patchData {
 		if v == nil {
 			delete(userData, k)
@@ -335,7 +1128,14 @@ func (s *Store) UserDataPatch(c *rest.Context) error {
 			userData[k] = v
 		}
 	}
-	return s.save(sectionUserData, name, userData)
+}
+
+// patchUserData объединяет дополнительные данные пользователя с переданными.
+// Ключи со значением null удаляются.
+func (s *Store) patchUserData(name string, patchData rest.JSON) error {
+	return s.updateUserData(name, func(userData rest.JSON) {
+		mergeUserData(userData, patchData)
+	})
 }
 
 // UserData отдает дополнительные пользовательские данные.
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mdigger/rest"
+	bolt "go.etcd.io/bbolt"
+)
+
+// resetTokens возвращает количество сохраненных токенов сброса пароля.
+func resetTokens(t *testing.T, store *Store) (count int) {
+	t.Helper()
+	if err := store.db.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket([]byte(sectionReset)); bucket != nil {
+			count = bucket.Stats().KeyN
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestPasswordTokenProvider(t *testing.T) {
+	var store = testStore(t)
+	for name, user := range map[string]*User{
+		"azure@test.com":  {Group: "test", Tenant: "tenant", Password: "secret"},
+		"google@test.com": {Group: "test", Provider: "google", Password: "secret"},
+	} {
+		if err := store.save(sectionUsers, name, user); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.passwordToken(name, time.Minute); err == nil {
+			t.Errorf("%s: reset token issued", name)
+		}
+	}
+	if n := resetTokens(t, store); n != 0 {
+		t.Fatalf("%d reset tokens stored", n)
+	}
+}
+
+// saveResetToken сохраняет токен сброса пароля с указанным временем окончания
+// действия.
+func saveResetToken(t *testing.T, store *Store, token, user string, expires time.Time) {
+	t.Helper()
+	if err := store.save(sectionReset, hashAPIKey(token), &ResetData{
+		User:    user,
+		Created: expires.Add(-ValidTokenPeriod),
+		Expires: expires,
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemoveResetTokens(t *testing.T) {
+	var store = testStore(t)
+	var now = time.Now()
+	saveResetToken(t, store, "valid", "user@test.com", now.Add(time.Hour))
+	saveResetToken(t, store, "expired", "user@test.com", now.Add(-time.Hour))
+	saveResetToken(t, store, "other", "other@test.com", now.Add(time.Hour))
+	// токен в старом формате без времени окончания действия
+	if err := store.save(sectionReset, "legacy@test.com", "token"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PurgeResetTokens(); err != nil {
+		t.Fatal(err)
+	}
+	if n := resetTokens(t, store); n != 2 {
+		t.Fatalf("%d reset tokens after purge", n)
+	}
+	if err := store.db.Update(func(tx *bolt.Tx) error {
+		return removeResetTokens(tx, "user@test.com")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n := resetTokens(t, store); n != 1 {
+		t.Fatalf("%d reset tokens after remove", n)
+	}
+	if _, err := store.resetData("other", false, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResetData(t *testing.T) {
+	var store = testStore(t)
+	var now = time.Now()
+	saveResetToken(t, store, "valid", "user@test.com", now.Add(time.Hour))
+	saveResetToken(t, store, "expired", "user@test.com", now.Add(-time.Hour))
+	if _, err := store.resetData("unknown", true, nil); err == nil {
+		t.Fatal("unknown token accepted")
+	}
+	// токен с истекшим временем действия удаляется при обращении
+	if _, err := store.resetData("expired", false, nil); err == nil {
+		t.Fatal("expired token accepted")
+	}
+	if n := resetTokens(t, store); n != 1 {
+		t.Fatalf("%d reset tokens after expired check", n)
+	}
+	reset, err := store.resetData("valid", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reset.User != "user@test.com" {
+		t.Fatalf("bad reset data %+v", reset)
+	}
+	// при ошибке проверки токен остается действительным
+	var errCheck = errors.New("check failed")
+	if _, err := store.resetData("valid", true, func(*ResetData) error {
+		return errCheck
+	}); err != errCheck {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := store.resetData("valid", true, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.resetData("valid", false, nil); err == nil {
+		t.Fatal("used token accepted")
+	}
+}
+
+func TestOrphans(t *testing.T) {
+	var store = testStore(t)
+	var expires = time.Now().Add(time.Hour)
+	for _, item := range []struct {
+		section, key string
+		value        interface{}
+	}{
+		{sectionUsers, "user@test.com", &User{Email: "user@test.com"}},
+		{sectionAdmins, "admin", &Admin{Name: "admin"}},
+		{sectionUserData, "user@test.com", rest.JSON{"phone": "1"}},
+		{sectionUserData, "lost@test.com", rest.JSON{"phone": "2"}},
+		{sectionReset, hashAPIKey("user"), &ResetData{User: "user@test.com", Expires: expires}},
+		{sectionReset, hashAPIKey("lost"), &ResetData{User: "lost@test.com", Expires: expires}},
+		{sectionSessions, "user", &RefreshToken{User: "user@test.com", Expires: expires}},
+		{sectionSessions, "lost", &RefreshToken{User: "lost@test.com", Expires: expires}},
+		{sectionEnroll, "lost", &Enrollment{User: "lost@test.com", Expires: expires}},
+		{sectionDevices, "lost", &Device{User: "lost@test.com"}},
+		{sectionCerts, "1", &Certificate{User: "user@test.com"}},
+		{sectionCerts, "2", &Certificate{User: "lost@test.com"}},
+		{sectionKeys, "admin", &APIKey{Admin: "admin"}},
+		{sectionKeys, "lost", &APIKey{Admin: "lost"}},
+	} {
+		if err := store.save(item.section, item.key, item.value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var want = map[string][]string{
+		sectionUserData: {"lost@test.com"},
+		sectionReset:    {hashAPIKey("lost")},
+		sectionSessions: {"lost"},
+		sectionEnroll:   {"lost"},
+		sectionDevices:  {"lost"},
+		sectionCerts:    {"2"},
+		sectionKeys:     {"lost"},
+	}
+	orphans, err := store.Orphans(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(orphans, want) {
+		t.Fatalf("orphans %v, want %v", orphans, want)
+	}
+	if orphans, err = store.Orphans(true); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(orphans, want) {
+		t.Fatalf("removed %v, want %v", orphans, want)
+	}
+	if orphans, err = store.Orphans(false); err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 0 {
+		t.Fatalf("orphans left after sweep: %v", orphans)
+	}
+	// потерянные сертификаты отзываются, но не удаляются
+	var cert = new(Certificate)
+	if err := store.load(sectionCerts, "2", cert); err != nil {
+		t.Fatal(err)
+	}
+	if cert.Revoked == nil {
+		t.Fatal("orphaned certificate not revoked")
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	var store = testStore(t)
+	if err := store.updateUser("user@test.com", func(*User) error { return nil }); err != rest.ErrNotFound {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := store.save(sectionUsers, "user@test.com", &User{Group: "old"}); err != nil {
+		t.Fatal(err)
+	}
+	// изменения, сохраненные после загрузки пользователя, не теряются
+	stale, err := store.User("user@test.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.save(sectionUsers, "user@test.com", &User{Group: "new"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.updateUser(stale.Email, func(user *User) error {
+		if user.Email != "user@test.com" {
+			t.Errorf("bad email %q", user.Email)
+		}
+		user.Name = "User"
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	user, err := store.User("user@test.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Name != "User" || user.Group != "new" {
+		t.Fatalf("bad user %+v", user)
+	}
+}
+
+func TestUpdateUserData(t *testing.T) {
+	var store = testStore(t)
+	if err := store.patchUserData("user@test.com", rest.JSON{
+		"a": "1", "b": "2", "c": "3"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.patchUserData("user@test.com", rest.JSON{
+		"b": nil, "d": "4"}); err != nil {
+		t.Fatal(err)
+	}
+	var userData = make(rest.JSON)
+	if err := store.load(sectionUserData, "user@test.com", &userData); err != nil {
+		t.Fatal(err)
+	}
+	if want := (rest.JSON{"a": "1", "c": "3", "d": "4"}); !reflect.DeepEqual(userData, want) {
+		t.Fatalf("user data %v, want %v", userData, want)
+	}
+}
@@ -0,0 +1,621 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mdigger/rest"
+	bolt "go.etcd.io/bbolt"
+)
+
+// webPage описывает данные, передаваемые в шаблон страницы.
+type webPage struct {
+	Lang    string    // язык страницы
+	Title   string    // ключ сообщения с заголовком страницы
+	CSRF    string    // токен для защиты от подделки запросов
+	Token   string    // токен для сброса пароля
+	Email   string    // email пользователя
+	Expires time.Time // время окончания действия токена
+	Errors  []string  // ключи сообщений об ошибках
+	// задача, которую необходимо решить перед запросом сброса пароля
+	Challenge  string
+	Difficulty int
+}
+
+// defaultWebLanguage задает язык страниц по умолчанию.
+const defaultWebLanguage = "en"
+
+// csrfCookie задает имя cookie с токеном для защиты от подделки запросов.
+const csrfCookie = "csrf"
+
+// errPasswordPolicy возвращается, если пароль не соответствует требованиям.
+var errPasswordPolicy = errors.New("password policy")
+
+// webMessages содержит встроенные переводы сообщений страниц.
+var webMessages = map[string]map[string]string{
+	"en": {
+		"title.reset":       "Reset password",
+		"title.sent":        "Check your email",
+		"title.password":    "Choose a new password",
+		"title.change":      "Change password",
+		"title.done":        "Password changed",
+		"title.error":       "Something went wrong",
+		"text.reset":        "Enter the email address of your account and we will send you a link to choose a new password.",
+		"text.sent":         "If an account with this address exists, we have sent it a link to choose a new password.",
+		"text.password":     "Choose a new password for your account.",
+		"text.expires":      "The link is valid until",
+		"text.change":       "Enter your current password and choose a new one.",
+		"text.done":         "Your password has been changed. Sessions on your other devices have been signed out.",
+		"label.email":       "Email",
+		"label.current":     "Current password",
+		"label.password":    "New password",
+		"label.confirm":     "Repeat new password",
+		"button.reset":      "Send link",
+		"button.password":   "Set password",
+		"button.change":     "Change password",
+		"link.reset":        "Forgot your password?",
+		"link.change":       "Change password",
+		"error.csrf":        "The form has expired. Please reload the page and try again.",
+		"error.token":       "This link is invalid or has expired. Please request a new one.",
+		"error.credentials": "Wrong email or password.",
+		"error.required":    "Please fill in all fields.",
+		"error.mismatch":    "The passwords do not match.",
+		"error.password":    "This password cannot be used.",
+		"error.limit":       "Too many requests. Please try again later.",
+		"error.failed":      "Something went wrong. Please try again later.",
+		"error.challenge":   "The check did not pass. Please try again.",
+		"error.provider":    "The password of this account is managed by your organization.",
+		"rule.minLength":    "The password is too short.",
+		"rule.upper":        "The password must contain an uppercase letter.",
+		"rule.lower":        "The password must contain a lowercase letter.",
+		"rule.digit":        "The password must contain a digit.",
+		"rule.special":      "The password must contain a special character.",
+		"rule.notEmail":     "The password must not match your email.",
+		"rule.denyList":     "The password is too common.",
+	},
+	"ru": {
+		"title.reset":       "Сброс пароля",
+		"title.sent":        "Проверьте почту",
+		"title.password":    "Новый пароль",
+		"title.change":      "Смена пароля",
+		"title.done":        "Пароль изменен",
+		"title.error":       "Что-то пошло не так",
+		"text.reset":        "Укажите email вашей учетной записи, и мы отправим на него ссылку для выбора нового пароля.",
+		"text.sent":         "Если учетная запись с таким адресом существует, на него отправлена ссылка для выбора нового пароля.",
+		"text.password":     "Выберите новый пароль для вашей учетной записи.",
+		"text.expires":      "Ссылка действительна до",
+		"text.change":       "Укажите текущий пароль и выберите новый.",
+		"text.done":         "Пароль изменен. Сессии на других ваших устройствах завершены.",
+		"label.email":       "Email",
+		"label.current":     "Текущий пароль",
+		"label.password":    "Новый пароль",
+		"label.confirm":     "Повторите новый пароль",
+		"button.reset":      "Отправить ссылку",
+		"button.password":   "Сохранить пароль",
+		"button.change":     "Изменить пароль",
+		"link.reset":        "Забыли пароль?",
+		"link.change":       "Сменить пароль",
+		"error.csrf":        "Форма устарела. Обновите страницу и попробуйте еще раз.",
+		"error.token":       "Ссылка недействительна или срок ее действия истек. Запросите новую.",
+		"error.credentials": "Неверный email или пароль.",
+		"error.required":    "Заполните все поля.",
+		"error.mismatch":    "Пароли не совпадают.",
+		"error.password":    "Этот пароль нельзя использовать.",
+		"error.limit":       "Слишком много запросов. Попробуйте позже.",
+		"error.failed":      "Не удалось выполнить запрос. Попробуйте позже.",
+		"error.challenge":   "Проверка не пройдена. Попробуйте еще раз.",
+		"error.provider":    "Паролем этой учетной записи управляет ваша организация.",
+		"rule.minLength":    "Пароль слишком короткий.",
+		"rule.upper":        "Пароль должен содержать заглавную букву.",
+		"rule.lower":        "Пароль должен содержать строчную букву.",
+		"rule.digit":        "Пароль должен содержать цифру.",
+		"rule.special":      "Пароль должен содержать специальный символ.",
+		"rule.notEmail":     "Пароль не должен совпадать с email.",
+		"rule.denyList":     "Пароль слишком распространенный.",
+	},
+}
+
+// webPages содержит встроенные шаблоны страниц. Шаблон layout задает общее
+// оформление, а содержимое страницы подставляется в него как content.
+var webPages = map[string]string{
+	"layout": `<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{t .Title}}</title>
+<style>
+body{font-family:sans-serif;background:#f4f4f4;color:#222;margin:0}
+main{max-width:24em;margin:4em auto;padding:2em;background:#fff;border-radius:4px}
+h1{font-size:1.4em;margin-top:0}
+label{display:block;margin:1em 0 .3em}
+input{box-sizing:border-box;width:100%;padding:.5em;font-size:1em}
+button{margin-top:1.5em;padding:.6em 1.2em;font-size:1em}
+.error{color:#b00}
+.note{color:#666;font-size:.9em}
+</style>
+</head>
+<body>
+<main>
+<h1>{{t .Title}}</h1>
+{{range .Errors}}<p class="error">{{t .}}</p>
+{{end}}{{template "content" .}}
+</main>
+</body>
+</html>
+`,
+	"reset": `<p>{{t "text.reset"}}</p>
+<form method="post"{{if .Challenge}} data-difficulty="{{.Difficulty}}"{{end}}>
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+{{if .Challenge}}<input type="hidden" name="challenge" value="{{.Challenge}}">
+<input type="hidden" name="nonce" value="">
+{{end}}<label for="email">{{t "label.email"}}</label>
+<input id="email" name="email" type="email" value="{{.Email}}" required autofocus>
+<button type="submit">{{t "button.reset"}}</button>
+</form>
+<p><a href="/web/change">{{t "link.change"}}</a></p>
+{{if .Challenge}}<script src="/web/pow.js"></script>
+{{end}}`,
+	"sent": `<p>{{t "text.sent"}}</p>
+`,
+	"password": `<p>{{t "text.password"}}</p>
+{{if not .Expires.IsZero}}<p class="note">{{t "text.expires"}} {{.Expires.Format "2006-01-02 15:04 MST"}}</p>
+{{end}}<form method="post">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<label for="password">{{t "label.password"}}</label>
+<input id="password" name="password" type="password" autocomplete="new-password" required autofocus>
+<label for="confirm">{{t "label.confirm"}}</label>
+<input id="confirm" name="confirm" type="password" autocomplete="new-password" required>
+<button type="submit">{{t "button.password"}}</button>
+</form>
+`,
+	"change": `<p>{{t "text.change"}}</p>
+<form method="post">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<label for="email">{{t "label.email"}}</label>
+<input id="email" name="email" type="email" value="{{.Email}}" autocomplete="username" required autofocus>
+<label for="current">{{t "label.current"}}</label>
+<input id="current" name="current" type="password" autocomplete="current-password" required>
+<label for="password">{{t "label.password"}}</label>
+<input id="password" name="password" type="password" autocomplete="new-password" required>
+<label for="confirm">{{t "label.confirm"}}</label>
+<input id="confirm" name="confirm" type="password" autocomplete="new-password" required>
+<button type="submit">{{t "button.change"}}</button>
+</form>
+<p><a href="/web/reset">{{t "link.reset"}}</a></p>
+`,
+	"done": `<p>{{t "text.done"}}</p>
+`,
+	"error": `<p><a href="/web/reset">{{t "link.reset"}}</a></p>
+`,
+}
+
+// powScript решает в браузере задачу перед отправкой формы запроса сброса
+// пароля.
+const powScript = `(function () {
+  var form = document.querySelector("form[data-difficulty]");
+  if (!form || !window.crypto || !crypto.subtle || !window.TextEncoder) {
+    return;
+  }
+  var difficulty = parseInt(form.getAttribute("data-difficulty"), 10);
+  var solving = false;
+  function zeros(hash) {
+    var n = 0;
+    for (var i = 0; i < hash.length; i++) {
+      if (hash[i] === 0) {
+        n += 8;
+        continue;
+      }
+      for (var b = hash[i]; !(b & 0x80); b <<= 1) {
+        n++;
+      }
+      break;
+    }
+    return n;
+  }
+  form.addEventListener("submit", function (event) {
+    if (form.elements.nonce.value) {
+      return;
+    }
+    event.preventDefault();
+    if (solving) {
+      return;
+    }
+    solving = true;
+    var challenge = form.elements.challenge.value;
+    var encoder = new TextEncoder();
+    var nonce = 0;
+    (function next() {
+      crypto.subtle.digest("SHA-256", encoder.encode(challenge + ":" + nonce))
+        .then(function (hash) {
+          if (zeros(new Uint8Array(hash)) >= difficulty) {
+            form.elements.nonce.value = String(nonce);
+            form.submit();
+            return;
+          }
+          nonce++;
+          next();
+        });
+    })();
+  });
+})();
+`
+
+// webLanguage возвращает язык страницы. Язык задается параметром запроса
+// ?lang или выбирается по заголовку Accept-Language из языков, для которых
+// есть переводы.
+func webLanguage(r *http.Request) string {
+	var list = []string{r.URL.Query().Get("lang")}
+	for _, lang := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		list = append(list, strings.SplitN(lang, ";", 2)[0])
+	}
+	for _, lang := range list {
+		// используется только основной язык без указания региона
+		lang = strings.ToLower(strings.TrimSpace(strings.SplitN(lang, "-", 2)[0]))
+		if _, ok := webMessages[lang]; ok {
+			return lang
+		}
+	}
+	return defaultWebLanguage
+}
+
+// webFuncs возвращает функции шаблонов страниц для указанного языка. Функция
+// t возвращает перевод сообщения, а если его нет — перевод на языке по
+// умолчанию или сам ключ.
+func webFuncs(lang string) template.FuncMap {
+	return template.FuncMap{
+		"t": func(key string) string {
+			if text, ok := webMessages[lang][key]; ok {
+				return text
+			}
+			if text, ok := webMessages[defaultWebLanguage][key]; ok {
+				return text
+			}
+			return key
+		},
+	}
+}
+
+// pageTemplate возвращает текст шаблона страницы. Шаблоны, сохраненные в
+// хранилище для конкретного языка (name.lang) или для всех языков (name),
+// заменяют встроенные.
+func (s *Store) pageTemplate(name, lang string) (string, error) {
+	var text string
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		var bucket = tx.Bucket([]byte(sectionPages))
+		if bucket == nil {
+			return nil
+		}
+		for _, key := range []string{name + "." + lang, name} {
+			if data := bucket.Get([]byte(key)); data != nil {
+				text = string(data)
+				break
+			}
+		}
+		return nil
+	}); err != nil {
+		return "", err
+	}
+	if text == "" {
+		text = webPages[name]
+	}
+	return text, nil
+}
+
+// renderPage формирует страницу с использованием шаблона и отдает ее.
+func (s *Store) renderPage(c *rest.Context, name string, page *webPage) error {
+	page.Lang = webLanguage(c.Request)
+	page.Title = "title." + name
+	var tmpl = template.New("").Funcs(webFuncs(page.Lang))
+	for _, part := range []string{"layout", name} {
+		text, err := s.pageTemplate(part, page.Lang)
+		if err != nil {
+			return err
+		}
+		if part == name {
+			part = "content"
+		}
+		if _, err := tmpl.New(part).Parse(text); err != nil {
+			return err
+		}
+	}
+	var buf = new(bytes.Buffer)
+	if err := tmpl.ExecuteTemplate(buf, "layout", page); err != nil {
+		return err
+	}
+	c.SetHeader("Content-Type", "text/html; charset=utf-8")
+	c.SetHeader("Cache-Control", "no-store")
+	c.SetHeader("X-Frame-Options", "DENY")
+	// адрес страницы сброса пароля содержит токен и не должен передаваться
+	c.SetHeader("Referrer-Policy", "no-referrer")
+	c.SetHeader("Content-Security-Policy", "default-src 'none'; "+
+		"script-src 'self'; style-src 'unsafe-inline'; form-action 'self'; "+
+		"frame-ancestors 'none'")
+	return c.Write(buf.Bytes())
+}
+
+// webCSRF возвращает токен для защиты форм от подделки запросов. Токен
+// сохраняется в cookie и должен быть передан вместе с формой.
+func webCSRF(c *rest.Context) (string, error) {
+	if cookie, err := c.Request.Cookie(csrfCookie); err == nil && cookie.Value != "" {
+		return cookie.Value, nil
+	}
+	token, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+	c.SetHeader("Set-Cookie", (&http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/web/",
+		HttpOnly: true,
+		Secure:   c.Request.TLS != nil || strings.HasPrefix(PublicURL, "https:"),
+		SameSite: http.SameSiteStrictMode,
+	}).String())
+	return token, nil
+}
+
+// checkCSRF возвращает true, если токен из формы совпадает с токеном в
+// cookie.
+func checkCSRF(c *rest.Context) bool {
+	cookie, err := c.Request.Cookie(csrfCookie)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookie.Value),
+		[]byte(c.Request.PostFormValue("csrf"))) == 1
+}
+
+// renderForm отдает страницу с формой, добавляя в нее токен для защиты от
+// подделки запросов.
+func (s *Store) renderForm(c *rest.Context, name string, page *webPage) error {
+	token, err := webCSRF(c)
+	if err != nil {
+		return err
+	}
+	page.CSRF = token
+	return s.renderPage(c, name, page)
+}
+
+// ruleErrors возвращает ключи сообщений для не выполненных правил проверки
+// пароля.
+func ruleErrors(unmet []string) []string {
+	var list = make([]string, len(unmet))
+	for i, rule := range unmet {
+		list[i] = "rule." + rule
+	}
+	return list
+}
+
+// renderReset отдает страницу для запроса сброса пароля. Если требуется
+// решение задачи, то она добавляется в форму.
+func (s *Store) renderReset(c *rest.Context, page *webPage) error {
+	if page.Difficulty = resetPolicy().Difficulty; page.Difficulty > 0 {
+		challenge, _, err := newChallenge()
+		if err != nil {
+			return err
+		}
+		page.Challenge = challenge
+	}
+	return s.renderForm(c, "reset", page)
+}
+
+// WebReset отдает страницу для запроса сброса пароля.
+func (s *Store) WebReset(c *rest.Context) error {
+	return s.renderReset(c, new(webPage))
+}
+
+// WebScript отдает скрипт для решения задачи перед запросом сброса пароля.
+func (s *Store) WebScript(c *rest.Context) error {
+	c.SetHeader("Content-Type", "application/javascript; charset=utf-8")
+	return c.Write([]byte(powScript))
+}
+
+// WebResetSubmit отправляет пользователю ссылку для сброса пароля. Чтобы не
+// раскрывать наличие учетной записи, ответ не зависит от того, найден ли
+// пользователь.
+func (s *Store) WebResetSubmit(c *rest.Context) error {
+	var page = &webPage{Email: strings.TrimSpace(c.Request.PostFormValue("email"))}
+	if !checkCSRF(c) {
+		page.Errors = []string{"error.csrf"}
+		return s.renderReset(c, page)
+	}
+	if page.Email == "" {
+		page.Errors = []string{"error.required"}
+		return s.renderReset(c, page)
+	}
+	switch err := s.requestReset(c, page.Email, c.Request.PostFormValue("challenge"),
+		c.Request.PostFormValue("nonce")); err {
+	case nil:
+		return s.renderPage(c, "sent", page)
+	case errResetChallenge:
+		page.Errors = []string{"error.challenge"}
+	case errResetLimit:
+		c.Status(http.StatusTooManyRequests)
+		page.Errors = []string{"error.limit"}
+	default:
+		c.AddLogField("error", err.Error())
+		c.Status(http.StatusInternalServerError)
+		return s.renderPage(c, "error", &webPage{Errors: []string{"error.failed"}})
+	}
+	return s.renderReset(c, page)
+}
+
+// WebPassword отдает страницу для выбора нового пароля по ссылке из письма.
+func (s *Store) WebPassword(c *rest.Context) error {
+	reset, err := s.resetData(c.Param("token"), false, nil)
+	if err != nil {
+		return s.renderPage(c, "error", &webPage{Errors: []string{"error.token"}})
+	}
+	return s.renderForm(c, "password", &webPage{Expires: reset.Expires})
+}
+
+// WebPasswordSubmit устанавливает выбранный пользователем новый пароль по
+// токену для сброса пароля.
+func (s *Store) WebPasswordSubmit(c *rest.Context) error {
+	var page = new(webPage)
+	var password = c.Request.PostFormValue("password")
+	switch {
+	case !checkCSRF(c):
+		page.Errors = []string{"error.csrf"}
+	case password == "":
+		page.Errors = []string{"error.required"}
+	case password != c.Request.PostFormValue("confirm"):
+		page.Errors = []string{"error.mismatch"}
+	case Password(password).Hashed():
+		page.Errors = []string{"error.password"}
+	}
+	if page.Errors != nil {
+		return s.renderForm(c, "password", page)
+	}
+	// пароль, не соответствующий требованиям, не приводит к использованию
+	// токена
+	var unmet []string
+	reset, err := s.resetData(c.Param("token"), true, func(reset *ResetData) error {
+		if unmet = passwordPolicy.Check(password, reset.User); len(unmet) > 0 {
+			return errPasswordPolicy
+		}
+		return nil
+	})
+	if err == errPasswordPolicy {
+		page.Errors = ruleErrors(unmet)
+		return s.renderForm(c, "password", page)
+	}
+	if err != nil {
+		c.AddLogField("error", err.Error())
+		return s.renderPage(c, "error", &webPage{Errors: []string{"error.token"}})
+	}
+	c.AddLogField("user", reset.User) // добавляем в лог имя пользователя
+	user, err := s.User(reset.User)
+	if err != nil {
+		c.AddLogField("error", err.Error())
+		return s.renderPage(c, "error", &webPage{Errors: []string{"error.token"}})
+	}
+	user.Password = Password(password)
+	user.Updated = time.Now().UTC()
+	if err := s.revokeTokens(user); err != nil {
+		return err
+	}
+	return s.renderPage(c, "done", new(webPage))
+}
+
+// WebChange отдает страницу для смены пароля пользователем.
+func (s *Store) WebChange(c *rest.Context) error {
+	return s.renderForm(c, "change", new(webPage))
+}
+
+// WebChangeSubmit изменяет пароль пользователя после проверки текущего.
+func (s *Store) WebChangeSubmit(c *rest.Context) error {
+	var page = &webPage{Email: strings.TrimSpace(c.Request.PostFormValue("email"))}
+	var current = c.Request.PostFormValue("current")
+	var password = c.Request.PostFormValue("password")
+	switch {
+	case !checkCSRF(c):
+		page.Errors = []string{"error.csrf"}
+	case page.Email == "" || current == "" || password == "":
+		page.Errors = []string{"error.required"}
+	case password != c.Request.PostFormValue("confirm"):
+		page.Errors = []string{"error.mismatch"}
+	case Password(password).Hashed():
+		page.Errors = []string{"error.password"}
+	}
+	if page.Errors != nil {
+		return s.renderForm(c, "change", page)
+	}
+	user, err := s.passwordUser(c, page.Email, current)
+	if err != nil {
+		c.AddLogField("error", err.Error())
+		page.Errors = []string{"error.credentials"}
+		return s.renderForm(c, "change", page)
+	}
+	if user.TokenProvider() != "" {
+		page.Errors = []string{"error.provider"}
+		return s.renderForm(c, "change", page)
+	}
+	if unmet := passwordPolicy.Check(password, user.Email); len(unmet) > 0 {
+		page.Errors = ruleErrors(unmet)
+		return s.renderForm(c, "change", page)
+	}
+	user.Password = Password(password)
+	user.Updated = time.Now().UTC()
+	if err := s.revokeTokens(user); err != nil {
+		return err
+	}
+	return s.renderPage(c, "done", new(webPage))
+}
+
+// WebPages отдает список встроенных шаблонов страниц и шаблонов, сохраненных
+// в хранилище.
+func (s *Store) WebPages(c *rest.Context) error {
+	var builtin = make([]string, 0, len(webPages))
+	for name := range webPages {
+		builtin = append(builtin, name)
+	}
+	sort.Strings(builtin)
+	var custom = make([]string, 0)
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		var bucket = tx.Bucket([]byte(sectionPages))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			custom = append(custom, string(k))
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+	return c.Write(rest.JSON{"builtin": builtin, sectionPages: custom})
+}
+
+// WebPage отдает текст шаблона страницы: сохраненный в хранилище или
+// встроенный.
+func (s *Store) WebPage(c *rest.Context) error {
+	var name = c.Param("name")
+	var text string
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket([]byte(sectionPages)); bucket != nil {
+			text = string(bucket.Get([]byte(name)))
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if text == "" {
+		text = webPages[name]
+	}
+	if text == "" {
+		return c.Error(http.StatusNotFound, "page not found")
+	}
+	c.SetHeader("Content-Type", "text/html; charset=utf-8")
+	return c.Write([]byte(text))
+}
+
+// SetWebPage сохраняет шаблон страницы, заменяющий встроенный. Имя шаблона
+// совпадает с именем встроенного шаблона и может содержать через точку язык,
+// для которого он используется. Шаблон передается в теле запроса.
+func (s *Store) SetWebPage(c *rest.Context) error {
+	var name = c.Param("name")
+	if _, ok := webPages[strings.SplitN(name, ".", 2)[0]]; !ok {
+		return c.Error(http.StatusNotFound, "page not found")
+	}
+	data, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		return c.Error(http.StatusBadRequest, err.Error())
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return c.Error(http.StatusBadRequest, "page template required")
+	}
+	if _, err := template.New(name).Funcs(webFuncs(defaultWebLanguage)).
+		Parse(string(data)); err != nil {
+		return c.Error(http.StatusBadRequest, err.Error())
+	}
+	return s.save(sectionPages, name, data)
+}